@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -33,3 +34,96 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+type ErrCorruptRecord struct {
+	Offset uint64
+}
+
+func (e ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.DataLoss, fmt.Sprintf("Corrupt record at offset %d", e.Offset))
+
+	msg := fmt.Sprintf("The record at the requested offset failed its checksum: %d", e.Offset)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrCorruptRecord) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrBatchTooLarge struct {
+	Records uint64
+	Max     uint64
+}
+
+func (e ErrBatchTooLarge) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("Batch too large %d", e.Records))
+
+	msg := fmt.Sprintf("The batch holds more records than fit into a single segment (%d): %d", e.Max, e.Records)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrBatchTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrEmptyBatch struct{}
+
+func (e ErrEmptyBatch) GRPCStatus() *status.Status {
+	return status.New(codes.InvalidArgument, "Empty batch")
+}
+
+func (e ErrEmptyBatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+type ErrBatchKeysMismatch struct {
+	Keys   uint64
+	Values uint64
+}
+
+func (e ErrBatchKeysMismatch) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("Batch keys mismatch %d", e.Keys))
+
+	msg := fmt.Sprintf("The batch holds a different number of keys than values (%d): %d", e.Values, e.Keys)
+
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	std, err := st.WithDetails(d)
+
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrBatchKeysMismatch) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
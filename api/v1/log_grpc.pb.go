@@ -26,6 +26,8 @@ type LogServiceClient interface {
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (LogService_ConsumeStreamClient, error)
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (LogService_ProduceStreamClient, error)
+	ProduceBatch(ctx context.Context, in *ProduceBatchRequest, opts ...grpc.CallOption) (*ProduceBatchResponse, error)
+	OffsetForTime(ctx context.Context, in *OffsetForTimeRequest, opts ...grpc.CallOption) (*OffsetForTimeResponse, error)
 }
 
 type logServiceClient struct {
@@ -117,6 +119,24 @@ func (x *logServiceProduceStreamClient) Recv() (*ProduceResponse, error) {
 	return m, nil
 }
 
+func (c *logServiceClient) ProduceBatch(ctx context.Context, in *ProduceBatchRequest, opts ...grpc.CallOption) (*ProduceBatchResponse, error) {
+	out := new(ProduceBatchResponse)
+	err := c.cc.Invoke(ctx, "/api.v1.LogService/ProduceBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logServiceClient) OffsetForTime(ctx context.Context, in *OffsetForTimeRequest, opts ...grpc.CallOption) (*OffsetForTimeResponse, error) {
+	out := new(OffsetForTimeResponse)
+	err := c.cc.Invoke(ctx, "/api.v1.LogService/OffsetForTime", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServiceServer is the server API for LogService service.
 // All implementations must embed UnimplementedLogServiceServer
 // for forward compatibility
@@ -125,6 +145,8 @@ type LogServiceServer interface {
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
 	ConsumeStream(*ConsumeRequest, LogService_ConsumeStreamServer) error
 	ProduceStream(LogService_ProduceStreamServer) error
+	ProduceBatch(context.Context, *ProduceBatchRequest) (*ProduceBatchResponse, error)
+	OffsetForTime(context.Context, *OffsetForTimeRequest) (*OffsetForTimeResponse, error)
 	mustEmbedUnimplementedLogServiceServer()
 }
 
@@ -144,6 +166,12 @@ func (UnimplementedLogServiceServer) ConsumeStream(*ConsumeRequest, LogService_C
 func (UnimplementedLogServiceServer) ProduceStream(LogService_ProduceStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
 }
+func (UnimplementedLogServiceServer) ProduceBatch(context.Context, *ProduceBatchRequest) (*ProduceBatchResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProduceBatch not implemented")
+}
+func (UnimplementedLogServiceServer) OffsetForTime(context.Context, *OffsetForTimeRequest) (*OffsetForTimeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method OffsetForTime not implemented")
+}
 func (UnimplementedLogServiceServer) mustEmbedUnimplementedLogServiceServer() {}
 
 // UnsafeLogServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -240,6 +268,42 @@ func (x *logServiceProduceStreamServer) Recv() (*ProduceRequest, error) {
 	return m, nil
 }
 
+func _LogService_ProduceBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProduceBatchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServiceServer).ProduceBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.v1.LogService/ProduceBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServiceServer).ProduceBatch(ctx, req.(*ProduceBatchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LogService_OffsetForTime_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(OffsetForTimeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServiceServer).OffsetForTime(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/api.v1.LogService/OffsetForTime",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServiceServer).OffsetForTime(ctx, req.(*OffsetForTimeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // LogService_ServiceDesc is the grpc.ServiceDesc for LogService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -255,6 +319,14 @@ var LogService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Consume",
 			Handler:    _LogService_Consume_Handler,
 		},
+		{
+			MethodName: "ProduceBatch",
+			Handler:    _LogService_ProduceBatch_Handler,
+		},
+		{
+			MethodName: "OffsetForTime",
+			Handler:    _LogService_OffsetForTime_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -4,6 +4,7 @@ import (
 	// "distributed-services-in-go/internal/log"
 	"context"
 	api "distributed-services-in-go/api/v1"
+	"time"
 
 	"google.golang.org/grpc"
 	// "google.golang.org/grpc"
@@ -11,7 +12,11 @@ import (
 
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
+	AppendBatch([]*api.Record) (uint64, uint64, error)
 	Read(uint64) (*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	Wait(context.Context, uint64) error
+	SkipRemoved(uint64) uint64
 }
 
 type Config struct {
@@ -46,7 +51,7 @@ func newGrpcServer(config *Config) (*grpcServer, error) {
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	record := api.Record{Value: req.Value}
+	record := api.Record{Value: req.Value, Key: req.Key}
 	offset, err := s.commitLog.Append(&record)
 
 	if err != nil {
@@ -58,6 +63,32 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 	return response, nil
 }
 
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if len(req.Keys) > 0 && len(req.Keys) != len(req.Values) {
+		return nil, api.ErrBatchKeysMismatch{Keys: uint64(len(req.Keys)), Values: uint64(len(req.Values))}
+	}
+
+	records := make([]*api.Record, len(req.Values))
+
+	for i, value := range req.Values {
+		records[i] = &api.Record{Value: value}
+
+		if len(req.Keys) > 0 {
+			records[i].Key = req.Keys[i]
+		}
+	}
+
+	first, last, err := s.commitLog.AppendBatch(records)
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := &api.ProduceBatchResponse{FirstOffset: first, LastOffset: last}
+
+	return response, nil
+}
+
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
 	record, err := s.commitLog.Read(req.Offset)
 
@@ -70,6 +101,18 @@ func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api
 	return response, nil
 }
 
+func (s *grpcServer) OffsetForTime(ctx context.Context, req *api.OffsetForTimeRequest) (*api.OffsetForTimeResponse, error) {
+	offset, err := s.commitLog.OffsetForTime(time.UnixMilli(req.Timestamp))
+
+	if err != nil {
+		return nil, err
+	}
+
+	response := &api.OffsetForTimeResponse{Offset: offset}
+
+	return response, nil
+}
+
 func (s *grpcServer) ProduceStream(stream api.LogService_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -90,27 +133,41 @@ func (s *grpcServer) ProduceStream(stream api.LogService_ProduceStreamServer) er
 	}
 }
 
+// ConsumeStream sends every record from req.Offset on, blocking on the log
+// while the consumer is caught up.
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.LogService_ConsumeStreamServer) error {
-	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
+	ctx := stream.Context()
 
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
+	for {
+		if err := s.commitLog.Wait(ctx, req.Offset); err != nil {
+			if ctx.Err() != nil {
+				return nil
 			}
 
-			if err := stream.Send(res); err != nil {
-				return err
+			return err
+		}
+
+		res, err := s.Consume(ctx, req)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			// The record was removed. When its whole segment went, jump to the
+			// segment after it instead of stepping through every offset.
+			if next := s.commitLog.SkipRemoved(req.Offset); next > req.Offset {
+				req.Offset = next
+			} else {
+				req.Offset++
 			}
 
-			req.Offset++
+			continue
+		default:
+			return err
 		}
+
+		if err := stream.Send(res); err != nil {
+			return err
+		}
+
+		req.Offset++
 	}
 }
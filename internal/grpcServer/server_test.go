@@ -4,7 +4,10 @@ import (
 	"context"
 	"net"
 	"os"
+	"path"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	api "distributed-services-in-go/api/v1"
 	"distributed-services-in-go/internal/log"
@@ -19,6 +22,11 @@ func TestServer(t *testing.T) {
 	scenarios := map[string]func(t *testing.T, client api.LogServiceClient, config *Config){
 		"produce/consume a message to/from the log": testProduceConsume,
 		"consume past log boundary fails":           testConsumePastBoundary,
+		"consume corrupted record fails":            testConsumeCorrupted,
+		"produce a batch of messages":               testProduceBatch,
+		"look up an offset by time":                 testOffsetForTime,
+		"consume stream waits for new messages":     testConsumeStreamWaits,
+		"consume stream skips removed segments":     testConsumeStreamSkipsRemoved,
 	}
 
 	for scenario, fn := range scenarios {
@@ -159,3 +167,188 @@ func testProduceConsumeStream(t *testing.T, client api.LogServiceClient, config
 		require.Equal(t, res.Record, &api.Record{Value: record.Value, Offset: uint64(i)})
 	}
 }
+
+func testConsumeCorrupted(t *testing.T, client api.LogServiceClient, config *Config) {
+	ctx := context.Background()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Value: []byte("Hello World"),
+	})
+
+	require.NoError(t, err)
+
+	// Reading flushes the record to the store file
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+
+	require.NoError(t, err)
+
+	clog := config.commitLog.(*log.Log)
+
+	f, err := os.OpenFile(path.Join(clog.Dir, "0.store"), os.O_RDWR, 0644)
+
+	require.NoError(t, err)
+
+	// Overwrite the first byte of the record, just past the 16 byte store
+	// header and the 12 byte frame header
+	_, err = f.WriteAt([]byte{0xff}, 28)
+
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+
+	require.Nil(t, consume)
+
+	got := status.Code(err)
+
+	want := status.Code(api.ErrCorruptRecord{}.GRPCStatus().Err())
+
+	require.Equal(t, want, got)
+}
+
+func testProduceBatch(t *testing.T, client api.LogServiceClient, config *Config) {
+	ctx := context.Background()
+
+	values := [][]byte{[]byte("First Message"), []byte("Second Message"), []byte("Third Message")}
+	keys := [][]byte{[]byte("k1"), nil, []byte("k2")}
+
+	produce, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Values: values, Keys: keys})
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(0), produce.FirstOffset)
+	require.Equal(t, uint64(2), produce.LastOffset)
+
+	for i, value := range values {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.FirstOffset + uint64(i)})
+
+		require.NoError(t, err)
+
+		require.Equal(t, value, consume.Record.Value)
+		require.Equal(t, keys[i], consume.Record.Key)
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+
+	got := status.Code(err)
+
+	want := status.Code(api.ErrEmptyBatch{}.GRPCStatus().Err())
+
+	require.Equal(t, want, got)
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Values: values, Keys: keys[:1]})
+
+	got = status.Code(err)
+
+	want = status.Code(api.ErrBatchKeysMismatch{}.GRPCStatus().Err())
+
+	require.Equal(t, want, got)
+}
+
+func testOffsetForTime(t *testing.T, client api.LogServiceClient, config *Config) {
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Value: []byte("First Message")})
+
+	require.NoError(t, err)
+
+	time.Sleep(5 * time.Millisecond)
+
+	at := time.Now()
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{Value: []byte("Second Message")})
+
+	require.NoError(t, err)
+
+	res, err := client.OffsetForTime(ctx, &api.OffsetForTimeRequest{Timestamp: at.UnixMilli()})
+
+	require.NoError(t, err)
+
+	require.Equal(t, produce.Offset, res.Offset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+
+	require.NoError(t, err)
+
+	require.GreaterOrEqual(t, consume.Record.Timestamp, at.UnixMilli())
+}
+
+func testConsumeStreamWaits(t *testing.T, client api.LogServiceClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The stream starts before anything is produced and blocks until it is.
+	consumeStream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+
+	require.NoError(t, err)
+
+	values := [][]byte{[]byte("First Message"), []byte("Second message")}
+
+	for offset, value := range values {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Value: value})
+
+		require.NoError(t, err)
+
+		res, err := consumeStream.Recv()
+
+		require.NoError(t, err)
+
+		require.Equal(t, uint64(offset), res.Record.Offset)
+		require.Equal(t, value, res.Record.Value)
+	}
+}
+
+// missLog counts the reads of offsets the log no longer holds.
+type missLog struct {
+	CommitLog
+	misses atomic.Int32
+}
+
+func (l *missLog) Read(off uint64) (*api.Record, error) {
+	record, err := l.CommitLog.Read(off)
+
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		l.misses.Add(1)
+	}
+
+	return record, err
+}
+
+func testConsumeStreamSkipsRemoved(t *testing.T, client api.LogServiceClient, config *Config) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+
+	// Every record gets a segment of its own.
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 1
+
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Remove()
+
+	reads := &missLog{CommitLog: clog}
+	config.commitLog = reads
+
+	for i := 0; i < 5; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, clog.Truncate(2))
+
+	consumeStream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+
+	for _, want := range []uint64{3, 4} {
+		res, err := consumeStream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, want, res.Record.Offset)
+	}
+
+	// The stream jumped over the removed segments instead of reading every
+	// offset in them.
+	require.Equal(t, int32(1), reads.misses.Load())
+}
@@ -0,0 +1,104 @@
+package log
+
+import api "distributed-services-in-go/api/v1"
+
+// pendingAppend is an Append waiting in the commit queue. done is closed once
+// the records have been written, lead is closed when the Append has to commit
+// the next group itself.
+type pendingAppend struct {
+	records []*api.Record
+	off     uint64
+	err     error
+	batch   *syncBatch
+	done    chan struct{}
+	lead    chan struct{}
+}
+
+// enqueue adds p to the commit queue and returns once p has been written. The
+// first caller to find the queue idle becomes the leader and commits everything
+// queued behind it as one group; the leader then hands over to the next waiting
+// caller, so concurrent appenders share a single write lock and a single sync.
+func (l *Log) enqueue(p *pendingAppend) {
+	p.done = make(chan struct{})
+	p.lead = make(chan struct{})
+
+	l.queueMu.Lock()
+
+	l.queue = append(l.queue, p)
+
+	lead := !l.committing
+	l.committing = true
+
+	l.queueMu.Unlock()
+
+	if lead {
+		l.commitGroup()
+		return
+	}
+
+	select {
+	case <-p.done:
+	case <-p.lead:
+		l.commitGroup()
+	}
+}
+
+func (l *Log) commitGroup() {
+	l.queueMu.Lock()
+
+	group := l.queue
+	l.queue = nil
+
+	l.queueMu.Unlock()
+
+	l.commit(group)
+
+	l.queueMu.Lock()
+	defer l.queueMu.Unlock()
+
+	if len(l.queue) == 0 {
+		l.committing = false
+		return
+	}
+
+	close(l.queue[0].lead)
+}
+
+func (l *Log) commit(group []*pendingAppend) {
+	l.mu.Lock()
+
+	appended := uint64(0)
+
+	for _, p := range group {
+		p.off, p.err = l.append(p.records)
+
+		if p.err == nil {
+			appended += uint64(len(p.records))
+		}
+	}
+
+	if appended > 0 {
+		l.notifyAppended()
+	}
+
+	batch, sync := l.awaitSync(appended)
+
+	l.mu.Unlock()
+
+	// The fsync runs without the lock, reads carry on while it does. The group
+	// still waits for it, and so does the next one, which keeps the order of
+	// syncs the order of appends.
+	var err error
+
+	if sync != nil {
+		err = sync()
+	}
+
+	for _, p := range group {
+		if p.err == nil {
+			p.batch, p.err = batch, err
+		}
+
+		close(p.done)
+	}
+}
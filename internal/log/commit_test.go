@@ -0,0 +1,59 @@
+package log
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Sync.Policy = SyncEveryAppend
+	log := newTestLog(t, c)
+
+	const appenders = 50
+
+	// Hold the write lock so every appender queues behind the first leader
+	log.mu.Lock()
+
+	var wg sync.WaitGroup
+	offsets := make([]uint64, appenders)
+
+	for i := 0; i < appenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			off, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			offsets[i] = off
+		}(i)
+	}
+
+	require.Eventually(t, func() bool {
+		log.queueMu.Lock()
+		defer log.queueMu.Unlock()
+		return len(log.queue) == appenders-1
+	}, time.Second, time.Millisecond)
+
+	log.mu.Unlock()
+	wg.Wait()
+
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for i, off := range offsets {
+		require.Equal(t, uint64(i), off)
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+
+	log.queueMu.Lock()
+	defer log.queueMu.Unlock()
+	require.False(t, log.committing)
+	require.Empty(t, log.queue)
+}
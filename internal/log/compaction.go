@@ -0,0 +1,281 @@
+package log
+
+import (
+	"log"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+)
+
+// compactDir holds the segments being rewritten by the compactor. Leftovers of
+// an interrupted compaction are removed when the log is opened.
+const compactDir = ".compact"
+
+// Compacted describes a segment rewritten by the compactor.
+type Compacted struct {
+	BaseOffset  uint64
+	Records     uint64
+	Kept        uint64
+	BytesBefore uint64
+	BytesAfter  uint64
+}
+
+// Compact rewrites the closed segments so that only the newest record of every
+// key is kept. Records without a key are always kept, and tombstones are
+// dropped once they are older than Config.Compaction.TombstoneRetention.
+// Surviving records keep their offsets, a segment left without records is
+// removed.
+func (l *Log) Compact() ([]Compacted, error) {
+	if l.Config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
+	l.mu.RLock()
+	segments := slices.Clone(l.segments)
+	l.mu.RUnlock()
+
+	latest := map[string]uint64{}
+
+	for _, s := range segments {
+		err := l.scan(s, func(record *api.Record) error {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	compacted := []Compacted{}
+
+	for _, s := range segments[:len(segments)-1] {
+		c, err := l.compactSegment(s, latest)
+
+		if err != nil {
+			return compacted, err
+		}
+
+		if c != nil {
+			compacted = append(compacted, *c)
+		}
+	}
+
+	return compacted, nil
+}
+
+// keep reports whether compaction keeps record given the newest offset of
+// every key.
+func (l *Log) keep(record *api.Record, latest map[string]uint64) bool {
+	if len(record.Key) == 0 {
+		return true
+	}
+
+	if latest[string(record.Key)] != record.Offset {
+		return false
+	}
+
+	isTombstone := len(record.Value) == 0
+
+	if !isTombstone {
+		return true
+	}
+
+	return time.Since(time.UnixMilli(record.Timestamp)) < l.Config.Compaction.TombstoneRetention
+}
+
+// compactSegment rewrites s without the records compaction drops and swaps the
+// result in place of s. It returns nil when every record of s is kept.
+func (l *Log) compactSegment(s *segment, latest map[string]uint64) (*Compacted, error) {
+	c := &Compacted{BaseOffset: s.baseOffset, BytesBefore: s.store.size}
+
+	err := l.scan(s, func(record *api.Record) error {
+		c.Records++
+
+		if l.keep(record, latest) {
+			c.Kept++
+		}
+
+		return nil
+	})
+
+	if err != nil || c.Kept == c.Records {
+		return nil, err
+	}
+
+	bytesAfter, err := l.rewriteSegment(s, func(record *api.Record) bool {
+		return l.keep(record, latest)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.BytesAfter = bytesAfter
+
+	return c, nil
+}
+
+// rewriteSegment writes the records of s that keep accepts into a new segment,
+// in the current format and under the current config, and swaps it in place
+// of s. It returns the size of the new store.
+func (l *Log) rewriteSegment(s *segment, keep func(*api.Record) bool) (uint64, error) {
+	dir := path.Join(l.Dir, compactDir)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	dst, err := newSegment(dir, s.baseOffset, l.Config)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = l.scan(s, func(record *api.Record) error {
+		if !keep(record) {
+			return nil
+		}
+
+		dst.nextOffset = record.Offset
+
+		_, err := dst.Append(record)
+
+		return err
+	})
+
+	if err != nil {
+		dst.Close()
+		return 0, err
+	}
+
+	bytesAfter := dst.store.size
+
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return 0, err
+	}
+
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+
+	return bytesAfter, l.replaceSegment(s, dst)
+}
+
+// replaceSegment swaps the files of the compacted segment dst in place of s and
+// reopens them. s is removed instead when dst holds no records.
+//
+// The indexes of s are removed before the store of dst is renamed over the one
+// of s, so a crash at any point leaves one of the stores, whole, with either
+// its own indexes or none. Missing indexes are rebuilt when the segment is
+// opened.
+func (l *Log) replaceSegment(s, dst *segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := slices.Index(l.segments, s)
+
+	l.cache.reset()
+
+	if dst.store.size == dst.store.start {
+		l.segments = slices.Delete(l.segments, i, i+1)
+
+		return s.Remove()
+	}
+
+	if err := s.Close(); err != nil {
+		return err
+	}
+
+	for _, name := range []string{s.index.Name(), s.timeIndex.Name()} {
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+
+	renames := [][2]string{
+		{dst.store.Name(), s.store.Name()},
+		{dst.index.Name(), s.index.Name()},
+		{dst.timeIndex.Name(), s.timeIndex.Name()},
+	}
+
+	for _, rename := range renames {
+		if err := os.Rename(rename[0], rename[1]); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+
+	compacted, err := newSegment(l.Dir, s.baseOffset, l.Config)
+
+	if err != nil {
+		return err
+	}
+
+	compacted.nextOffset = s.nextOffset
+	mapClosed(compacted)
+	l.segments[i] = compacted
+
+	return nil
+}
+
+// scan calls fn for every record of s in order, skipping the offsets an earlier
+// compaction removed. The read lock is only held while reading a record so
+// appends are not held up.
+func (l *Log) scan(s *segment, fn func(*api.Record) error) error {
+	for off := s.baseOffset; ; off++ {
+		l.mu.RLock()
+
+		if off >= s.nextOffset {
+			l.mu.RUnlock()
+			return nil
+		}
+
+		record, err := s.Read(off)
+
+		l.mu.RUnlock()
+
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *Log) compact() {
+	compacted, err := l.Compact()
+
+	for _, c := range compacted {
+		log.Printf("compacted segment %d: kept %d of %d records (%d to %d bytes)", c.BaseOffset, c.Kept, c.Records, c.BytesBefore, c.BytesAfter)
+	}
+
+	if err != nil {
+		log.Printf("compaction: %v", err)
+	}
+}
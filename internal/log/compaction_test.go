@@ -0,0 +1,99 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompaction(t *testing.T) {
+	dir, err := os.MkdirTemp("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	c.Compaction.TombstoneRetention = time.Hour
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Key: []byte("k2"), Value: []byte("v1")},
+		{Key: []byte("k1"), Value: []byte("v2")},
+		{Value: []byte("no key")},
+		{Key: []byte("k2")},
+		{Key: []byte("k3"), Value: []byte("v1")},
+		{Key: []byte("k1"), Value: []byte("v3")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 4)
+
+	compacted, err := log.Compact()
+	require.NoError(t, err)
+	require.Len(t, compacted, 2)
+	require.Equal(t, uint64(0), compacted[0].BaseOffset)
+	require.Equal(t, uint64(0), compacted[0].Kept)
+	require.Equal(t, uint64(2), compacted[1].BaseOffset)
+	require.Equal(t, uint64(2), compacted[1].Records)
+	require.Equal(t, uint64(1), compacted[1].Kept)
+	require.Less(t, compacted[1].BytesAfter, compacted[1].BytesBefore)
+
+	requireCompacted := func(log *Log, removed []uint64, kept []uint64) {
+		t.Helper()
+		for _, off := range removed {
+			_, err := log.Read(off)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+		}
+		for _, off := range kept {
+			read, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, read.Offset)
+			require.Equal(t, records[off].Value, read.Value)
+		}
+	}
+
+	requireCompacted(log, []uint64{0, 1, 2}, []uint64{3, 4, 5, 6})
+
+	// Offsets survive reopening the log
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Repairs)
+	requireCompacted(log, []uint64{0, 1, 2}, []uint64{3, 4, 5, 6})
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	// A crash after the old indexes are gone leaves a store that is indexed
+	// again on open
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(log.segments[0].index.Name()))
+	require.NoError(t, os.Remove(log.segments[0].timeIndex.Name()))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.Repairs, 1)
+	require.Equal(t, uint64(1), log.Repairs[0].RecoveredTimeIndexEntries)
+	requireCompacted(log, []uint64{0, 1, 2}, []uint64{3, 4, 5, 6})
+
+	// Tombstones go once they are older than the grace period
+	log.Config.Compaction.TombstoneRetention = 0
+	compacted, err = log.Compact()
+	require.NoError(t, err)
+	require.Len(t, compacted, 1)
+	requireCompacted(log, []uint64{0, 1, 2, 4}, []uint64{3, 5, 6})
+
+	off, err = log.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.NoError(t, log.Close())
+}
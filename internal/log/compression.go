@@ -0,0 +1,184 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Codec compresses the record batches written to the store. Every batch frame
+// carries the ID of its codec, so the codec can change without rewriting old
+// segments. IDs below 16 are reserved for the codecs of this package.
+type Codec interface {
+	ID() byte
+	Encode(src []byte) ([]byte, error)
+	Decode(src []byte) ([]byte, error)
+}
+
+const (
+	gzipCodecID  byte = 1
+	flateCodecID byte = 2
+)
+
+// batchMarker starts the payload of a batch frame. A frame holding a single
+// marshaled record never starts with it, as 0 is not a valid protobuf tag.
+const batchMarker byte = 0
+
+// GzipCodec compresses batches with gzip. A zero Level uses the default
+// compression level.
+type GzipCodec struct {
+	Level int
+}
+
+func (c GzipCodec) ID() byte {
+	return gzipCodecID
+}
+
+func (c GzipCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := gzip.NewWriterLevel(&buf, compressionLevel(c.Level))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return finish(&buf, w, src)
+}
+
+func (c GzipCodec) Decode(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// FlateCodec compresses batches with raw DEFLATE. A zero Level uses the default
+// compression level.
+type FlateCodec struct {
+	Level int
+}
+
+func (c FlateCodec) ID() byte {
+	return flateCodecID
+}
+
+func (c FlateCodec) Encode(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w, err := flate.NewWriter(&buf, compressionLevel(c.Level))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return finish(&buf, w, src)
+}
+
+func (c FlateCodec) Decode(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func compressionLevel(level int) int {
+	if level == 0 {
+		return flate.DefaultCompression
+	}
+
+	return level
+}
+
+func finish(buf *bytes.Buffer, w io.WriteCloser, src []byte) ([]byte, error) {
+	if _, err := w.Write(src); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// codec returns the codec for id among the built-in ones and those of the
+// config.
+func (c Config) codec(id byte) (Codec, error) {
+	codecs := append([]Codec{GzipCodec{}, FlateCodec{}, c.Compression.Codec}, c.Compression.Codecs...)
+
+	for _, codec := range codecs {
+		if codec != nil && codec.ID() == id {
+			return codec, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown compression codec %d", id)
+}
+
+// encodeBatch builds the payload of a batch frame: the marker, the codec ID and
+// the compressed length-prefixed records.
+func encodeBatch(codec Codec, records [][]byte) ([]byte, error) {
+	var body []byte
+
+	for _, record := range records {
+		body = enc.AppendUint64(body, uint64(len(record)))
+		body = append(body, record...)
+	}
+
+	compressed, err := codec.Encode(body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{batchMarker, codec.ID()}, compressed...), nil
+}
+
+// decodeBatch returns the records of a batch frame payload. A payload that
+// does not decompress into whole records returns errCorruptFrame.
+func decodeBatch(c Config, payload []byte) ([][]byte, error) {
+	if len(payload) < 2 {
+		return nil, errCorruptFrame
+	}
+
+	codec, err := c.codec(payload[1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := codec.Decode(payload[2:])
+
+	if err != nil {
+		return nil, errCorruptFrame
+	}
+
+	var records [][]byte
+
+	for len(body) > 0 {
+		if uint64(len(body)) < lenWidth {
+			return nil, errCorruptFrame
+		}
+
+		size := enc.Uint64(body[:lenWidth])
+		body = body[lenWidth:]
+
+		if size > uint64(len(body)) {
+			return nil, errCorruptFrame
+		}
+
+		records = append(records, body[:size])
+		body = body[size:]
+	}
+
+	return records, nil
+}
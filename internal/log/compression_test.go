@@ -0,0 +1,100 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+// xorCodec stands in for a codec registered by a user of the package.
+type xorCodec struct{}
+
+func (xorCodec) ID() byte {
+	return 42
+}
+
+func (xorCodec) Encode(src []byte) ([]byte, error) {
+	dst := make([]byte, len(src))
+
+	for i, b := range src {
+		dst[i] = b ^ 0xff
+	}
+
+	return dst, nil
+}
+
+func (c xorCodec) Decode(src []byte) ([]byte, error) {
+	return c.Encode(src)
+}
+
+func TestCompression(t *testing.T) {
+	value := bytes.Repeat([]byte(`{"event":"click","user":"someone"}`), 8)
+
+	batch := func() []*api.Record {
+		records := make([]*api.Record, 10)
+
+		for i := range records {
+			records[i] = &api.Record{Value: value}
+		}
+
+		return records
+	}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024 * 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Compression.Codec = GzipCodec{}
+
+	log := newTestLog(t, c)
+
+	_, _, err := log.AppendBatch(batch())
+	require.NoError(t, err)
+
+	// The whole batch went into a single frame, much smaller than the values.
+	require.Equal(t, uint64(1), log.activeSegment.index.Entries())
+	require.Less(t, log.activeSegment.store.size, uint64(len(value)))
+
+	reopen := func(codec Codec) {
+		t.Helper()
+
+		require.NoError(t, log.Close())
+
+		c.Compression.Codec = codec
+		c.Compression.Codecs = []Codec{xorCodec{}}
+
+		log, err = NewLog(log.Dir, c)
+		require.NoError(t, err)
+		require.Empty(t, log.Repairs)
+		t.Cleanup(func() { log.Close() })
+	}
+
+	for _, codec := range []Codec{FlateCodec{Level: 9}, xorCodec{}} {
+		reopen(codec)
+
+		_, _, err := log.AppendBatch(batch())
+		require.NoError(t, err)
+	}
+
+	// Without a codec records are written raw, next to the compressed batches.
+	reopen(nil)
+
+	_, err = log.Append(&api.Record{Value: value})
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 31; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, value, got.Value)
+	}
+
+	// Frames of an unknown codec cannot be decoded.
+	payload, err := encodeBatch(xorCodec{}, [][]byte{value})
+	require.NoError(t, err)
+
+	_, err = decodeBatch(Config{}, payload)
+	require.ErrorContains(t, err, "unknown compression codec 42")
+}
@@ -1,9 +1,90 @@
 package log
 
+import "time"
+
+// SyncPolicy decides when appended records are fsynced to disk and, with it,
+// when Log.Append reports them as durable. Reads do not wait for the fsync and
+// may return records that are not yet durable.
+type SyncPolicy int
+
+const (
+	// SyncNever leaves flushing to the operating system.
+	SyncNever SyncPolicy = iota
+	// SyncEveryAppend fsyncs the active segment before every Append returns.
+	SyncEveryAppend
+	// SyncInterval fsyncs once Sync.Records records are waiting or Sync.Interval
+	// has passed, whichever comes first. Append blocks until its record is
+	// covered by a sync.
+	SyncInterval
+	// SyncOnRoll fsyncs a segment when it is rolled and when the log is closed.
+	SyncOnRoll
+)
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// MaxAge rolls the active segment once its first record is older,
+		// whether or not more records arrive.
+		MaxAge time.Duration
+		// IndexIntervalBytes makes the indexes sparse: a record only gets an
+		// entry, in the index and the time index, once this many store bytes
+		// were written since the last one, and reads and lookups by time scan
+		// forward from the nearest entry. Zero indexes every record.
+		IndexIntervalBytes uint64
+	}
+	Sync struct {
+		Policy   SyncPolicy
+		Records  uint64
+		Interval time.Duration
+	}
+	// Retention removes the oldest closed segments once the log holds more
+	// than MaxBytes of store data, once their newest record is older than
+	// MaxAge, or once all their offsets are below LowestOffset. The active
+	// segment is never removed. The cleaner runs every Interval.
+	Retention struct {
+		MaxBytes     uint64
+		MaxAge       time.Duration
+		LowestOffset uint64
+		Interval     time.Duration
+	}
+	// Compaction keeps only the newest record of every key in closed segments
+	// and drops tombstones older than TombstoneRetention. The compactor runs
+	// every Interval, or only through Log.Compact when Interval is zero.
+	Compaction struct {
+		TombstoneRetention time.Duration
+		Interval           time.Duration
+	}
+	// Compression compresses every appended batch into a single frame with
+	// Codec, leaving records uncompressed when it is nil. Frames written with
+	// GzipCodec, FlateCodec, Codec or any of Codecs can be read back.
+	Compression struct {
+		Codec  Codec
+		Codecs []Codec
+	}
+	// Encryption encrypts every store frame with AES-GCM under the current
+	// key of Keys, after compression. Frames stay plaintext when Keys is nil,
+	// but encrypted frames can only be read back with Keys set.
+	Encryption struct {
+		Keys KeyProvider
+	}
+	// Upgrade rewrites the segments written in an older store format in the
+	// background when Background is set. Log.Upgrade does the same on demand;
+	// either way older formats stay readable until then.
+	Upgrade struct {
+		Background bool
+	}
+	// ReadOnly opens the log without taking the directory lock, so it can be
+	// opened next to a writer; it sees the records the writer had flushed to
+	// its files when it was opened or last refreshed. Nothing is written to
+	// the directory: repairs only happen in memory, background jobs do not
+	// run, and appending or removing data returns ErrReadOnly.
+	ReadOnly bool
+	// Follow makes a read-only log refresh its view of the directory every
+	// Interval, so it keeps up with the records and segments its writer
+	// adds. With a zero Interval the view only changes through Log.Refresh.
+	Follow struct {
+		Interval time.Duration
 	}
 }
@@ -0,0 +1,134 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// KeyProvider supplies the AES keys store frames are encrypted with. Every
+// frame records the ID of its key, so keys can rotate as long as the old ones
+// stay available for reading.
+type KeyProvider interface {
+	// CurrentKey returns the ID and the key new frames are encrypted with.
+	CurrentKey() (uint32, []byte, error)
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider over a fixed set of keys.
+type StaticKeys struct {
+	Current uint32
+	Keys    map[uint32][]byte
+}
+
+func (k StaticKeys) CurrentKey() (uint32, []byte, error) {
+	key, err := k.Key(k.Current)
+
+	return k.Current, key, err
+}
+
+func (k StaticKeys) Key(id uint32) ([]byte, error) {
+	key, ok := k.Keys[id]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %d", id)
+	}
+
+	return key, nil
+}
+
+// encryptedMarker starts the payload of an encrypted frame. Like batchMarker it
+// can never start a marshaled record.
+const encryptedMarker byte = 1
+
+const (
+	keyIDWidth           = 4
+	encryptedHeaderWidth = 1 + keyIDWidth
+)
+
+var errNoKeyProvider = errors.New("encrypted frame but no key provider configured")
+
+// encryptFrame seals payload with AES-GCM under the current key. The marker and
+// the key ID are authenticated along with it.
+func encryptFrame(keys KeyProvider, payload []byte) ([]byte, error) {
+	id, key, err := keys.CurrentKey()
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, encryptedHeaderWidth, encryptedHeaderWidth+aead.NonceSize()+len(payload)+aead.Overhead())
+	header[0] = encryptedMarker
+	enc.PutUint32(header[1:], id)
+
+	nonce := make([]byte, aead.NonceSize())
+
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(append(header, nonce...), nonce, payload, header), nil
+}
+
+// decryptFrame opens an encrypted frame payload. A payload that fails to
+// authenticate returns errCorruptFrame.
+func decryptFrame(keys KeyProvider, payload []byte) ([]byte, error) {
+	if keys == nil {
+		return nil, errNoKeyProvider
+	}
+
+	if len(payload) < encryptedHeaderWidth {
+		return nil, errCorruptFrame
+	}
+
+	key, err := keys.Key(enc.Uint32(payload[1:encryptedHeaderWidth]))
+
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	header, sealed := payload[:encryptedHeaderWidth], payload[encryptedHeaderWidth:]
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errCorruptFrame
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, header)
+
+	if err != nil {
+		return nil, errCorruptFrame
+	}
+
+	return plaintext, nil
+}
+
+func isEncrypted(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == encryptedMarker
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestEncryption(t *testing.T) {
+	keys := StaticKeys{
+		Current: 1,
+		Keys: map[uint32][]byte{
+			1: bytes.Repeat([]byte{1}, 32),
+			2: bytes.Repeat([]byte{2}, 16),
+		},
+	}
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	c.Encryption.Keys = keys
+
+	log := newTestLog(t, c)
+
+	records := []*api.Record{
+		{Key: []byte("k1"), Value: []byte("secret v1")},
+		{Key: []byte("k1"), Value: []byte("secret v2")},
+		{Key: []byte("k2"), Value: []byte("secret v1")},
+	}
+
+	for _, record := range records[:2] {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+
+	// Rotate the key, frames written before stay readable.
+	require.NoError(t, log.Close())
+	keys.Current = 2
+	c.Encryption.Keys = keys
+
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	_, err = log.Append(records[2])
+	require.NoError(t, err)
+
+	for _, segment := range log.segments {
+		data, err := os.ReadFile(segment.store.Name())
+		require.NoError(t, err)
+		require.NotContains(t, string(data), "secret")
+	}
+
+	for off, want := range records {
+		got, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// Reader yields the plaintext frames.
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+
+	for _, want := range records {
+		size := enc.Uint64(b[:lenWidth])
+		got := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[headerWidth:headerWidth+size], got))
+		require.Equal(t, want.Value, got.Value)
+		b = b[headerWidth+size:]
+	}
+
+	require.Empty(t, b)
+
+	// Compaction rewrites the first segment under the current key.
+	compacted, err := log.Compact()
+	require.NoError(t, err)
+	require.Len(t, compacted, 1)
+
+	frame, err := log.segments[0].store.Read(log.segments[0].store.start)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), enc.Uint32(frame[1:encryptedHeaderWidth]))
+
+	got, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, records[1].Value, got.Value)
+
+	// A tampered frame fails to authenticate.
+	f, err := os.OpenFile(log.activeSegment.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	b = make([]byte, 1)
+	_, err = f.ReadAt(b, int64(storeHeaderWidth+headerWidth+encryptedHeaderWidth))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 0xff}, int64(storeHeaderWidth+headerWidth+encryptedHeaderWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.Read(2)
+	require.Equal(t, api.ErrCorruptRecord{Offset: 2}, err)
+}
+
+func TestEncryptionWithoutKeys(t *testing.T) {
+	c := Config{}
+	c.Encryption.Keys = StaticKeys{Keys: map[uint32][]byte{0: make([]byte, 32)}}
+
+	log := newTestLog(t, c)
+
+	_, err := log.Append(&api.Record{Value: []byte("secret")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	_, err = NewLog(log.Dir, Config{})
+	require.ErrorIs(t, err, errNoKeyProvider)
+}
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+)
+
+var errNotReadOnly = errors.New("only a read-only log can be refreshed")
+
+// Refresh updates the view of a read-only log to what its writer has flushed
+// since it was opened or last refreshed. Segments the writer removed are
+// dropped, segments it rewrote are reopened, and the newest segment is
+// reopened along with any created after it, picking up their new records.
+func (l *Log) Refresh() error {
+	if !l.Config.ReadOnly {
+		return errNotReadOnly
+	}
+
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
+	baseOffsets, _, err := l.discover()
+
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	kept := map[uint64]*segment{}
+
+	for _, s := range l.segments {
+		if s != l.activeSegment && !s.isReplaced() {
+			kept[s.baseOffset] = s
+		}
+	}
+
+	segments := []*segment{}
+	reused := map[*segment]bool{}
+
+	for _, baseOffset := range baseOffsets {
+		if s, ok := kept[baseOffset]; ok {
+			segments = append(segments, s)
+			reused[s] = true
+			continue
+		}
+
+		s, err := newSegment(l.Dir, baseOffset, l.Config)
+
+		// The writer removed the store after the directory was read. Missing
+		// index files do not end up here, they are rebuilt in memory.
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			closeUnused(segments, reused)
+			return err
+		}
+
+		segments = append(segments, s)
+	}
+
+	if len(segments) == 0 {
+		return fmt.Errorf("%s: no segments to read", l.Dir)
+	}
+
+	closeUnused(l.segments, reused)
+
+	for i := 1; i < len(segments); i++ {
+		segments[i-1].nextOffset = segments[i].baseOffset
+		mapClosed(segments[i-1])
+	}
+
+	l.cache.reset()
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	l.notifyAppended()
+
+	return nil
+}
+
+// closeUnused closes the segments that are not reused.
+func closeUnused(segments []*segment, reused map[*segment]bool) {
+	for _, s := range segments {
+		if reused[s] {
+			continue
+		}
+
+		if err := s.Close(); err != nil {
+			log.Printf("refresh: close segment %d: %v", s.baseOffset, err)
+		}
+	}
+}
+
+func (l *Log) refresh() {
+	if err := l.Refresh(); err != nil {
+		log.Printf("refresh: %v", err)
+	}
+}
+
+// isReplaced reports whether the store file of s was removed or replaced on
+// disk since s was opened, as retention and compaction do.
+func (s *segment) isReplaced() bool {
+	onDisk, err := os.Stat(s.store.Name())
+
+	if err != nil {
+		return true
+	}
+
+	opened, err := s.store.File.Stat()
+
+	return err != nil || !os.SameFile(onDisk, opened)
+}
@@ -0,0 +1,98 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFollow(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	c.Sync.Policy = SyncEveryAppend
+	writer := newTestLog(t, c)
+
+	append := func(n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			_, err := writer.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+
+	append(3)
+
+	c.ReadOnly = true
+	reader, err := NewLog(writer.Dir, c)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	requireHighest := func(want uint64) {
+		t.Helper()
+
+		highest, err := reader.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, want, highest)
+
+		for off := uint64(0); off <= want; off++ {
+			_, err := reader.Read(off)
+
+			if off < writer.segments[0].baseOffset {
+				require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+				continue
+			}
+
+			require.NoError(t, err)
+		}
+	}
+
+	requireHighest(2)
+
+	// New records in the newest segment and new segments show up, even when
+	// their index files are missing.
+	append(4)
+	requireHighest(2)
+
+	for _, ext := range []string{".index", ".timeindex"} {
+		require.NoError(t, os.Remove(path.Join(writer.Dir, fmt.Sprintf("%d%s", writer.segments[2].baseOffset, ext))))
+	}
+
+	require.NoError(t, reader.Refresh())
+	requireHighest(6)
+	require.Len(t, reader.segments, len(writer.segments))
+
+	// Segments the writer removes are dropped.
+	require.NoError(t, writer.Truncate(1))
+	require.NoError(t, reader.Refresh())
+	require.Equal(t, writer.segments[0].baseOffset, reader.segments[0].baseOffset)
+	requireHighest(6)
+
+	require.Equal(t, errNotReadOnly, writer.Refresh())
+}
+
+func TestFollowInterval(t *testing.T) {
+	c := Config{}
+	c.Sync.Policy = SyncEveryAppend
+	writer := newTestLog(t, c)
+
+	c.ReadOnly = true
+	c.Follow.Interval = 10 * time.Millisecond
+	reader, err := NewLog(writer.Dir, c)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	_, err = writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := reader.Read(0)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
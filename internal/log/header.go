@@ -0,0 +1,90 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Index files start with a header naming the file type and the version of its
+// layout, so the layout can change without breaking existing logs.
+const (
+	indexMagic     = "LIDX"
+	timeIndexMagic = "LTIX"
+
+	indexVersion     uint32 = 2
+	timeIndexVersion uint32 = 2
+
+	fileHeaderWidth uint64 = 8
+)
+
+// readHeader returns the version stored in the header of file, or 0 when the
+// file does not start with a header for magic.
+func readHeader(file *os.File, magic string) (uint32, error) {
+	header := make([]byte, fileHeaderWidth)
+
+	if _, err := file.ReadAt(header, 0); err == io.EOF {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	if string(header[:len(magic)]) != magic {
+		return 0, nil
+	}
+
+	return enc.Uint32(header[len(magic):]), nil
+}
+
+// writeHeader replaces the content of file with a header for magic followed by
+// entries.
+func writeHeader(file *os.File, magic string, version uint32, entries []byte) error {
+	header := make([]byte, fileHeaderWidth)
+
+	copy(header, magic)
+	enc.PutUint32(header[len(magic):], version)
+
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(header, entries...)); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// entriesSize returns the number of bytes following the header of file. A file
+// without a header, which only a read-only log leaves in place, has none.
+func entriesSize(file *os.File, magic string, version uint32) (uint64, error) {
+	current, err := readHeader(file, magic)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if current != 0 && current != version {
+		return 0, unsupportedVersion(file, current)
+	}
+
+	fileStat, err := file.Stat()
+
+	if err != nil {
+		return 0, err
+	}
+
+	if current == 0 || uint64(fileStat.Size()) < fileHeaderWidth {
+		return 0, nil
+	}
+
+	return uint64(fileStat.Size()) - fileHeaderWidth, nil
+}
+
+func unsupportedVersion(file *os.File, version uint32) error {
+	return fmt.Errorf("%s: unsupported format version %d", file.Name(), version)
+}
@@ -3,112 +3,179 @@ package log
 import (
 	"io"
 	"log"
+	"math"
 	"os"
-
-	"github.com/edsrzf/mmap-go"
+	"sort"
 )
 
 type index struct {
-	file *os.File
-	mmap mmap.MMap
-	size uint64
+	entryFile
 }
 
 var (
-	offsetWidth uint64 = 4
+	offsetWidth uint64 = 8
 	posWidth    uint64 = 8
 	entierWidth        = offsetWidth + posWidth
+
+	// Indexes of the headerless store versions 0 and 1 had no header and
+	// stored relative offsets in 4 bytes.
+	legacyOffsetWidth uint64 = 4
+	legacyEntryWidth         = legacyOffsetWidth + posWidth
 )
 
+// newIndex opens the index stored in file. MaxIndexBytes bounds the entries,
+// the file additionally carries a header. The file only grows towards that
+// bound as entries are written. Indexes written in the legacy
+// layout are migrated in place; a crash during the migration leaves an index
+// that recovery rebuilds from the store. A read-only index is not migrated but
+// starts out empty, and so does a read-only index whose file is missing,
+// passed as a nil file.
 func newIndex(file *os.File, config Config) (*index, error) {
+	var size uint64
 
-	fileStat, err := os.Stat(file.Name())
-
-	if err != nil {
-		log.Printf("os.Stat %v", err.Error())
-		return nil, err
-	}
+	if file != nil {
+		if !config.ReadOnly {
+			if err := upgradeIndex(file); err != nil {
+				return nil, err
+			}
+		}
 
-	size := uint64(fileStat.Size())
+		var err error
 
-	if err := os.Truncate(file.Name(), int64(config.Segment.MaxIndexBytes)); err != nil {
-		log.Printf("os.Truncate %v", err.Error())
-		return nil, err
+		if size, err = entriesSize(file, indexMagic, indexVersion); err != nil {
+			return nil, err
+		}
 	}
 
-	mmapBytes, err := mmap.Map(file, mmap.RDWR, 0)
+	f, err := openEntryFile(file, size, entierWidth, config)
 
 	if err != nil {
-		log.Printf("mmap.Map %v", err.Error())
 		return nil, err
 	}
 
-	return &index{file: file, mmap: mmapBytes, size: size}, nil
+	return &index{f}, nil
 }
 
-func (i *index) Close() error {
-	if err := i.mmap.Unmap(); err != nil {
+func upgradeIndex(file *os.File) error {
+	version, err := readHeader(file, indexMagic)
+
+	if err != nil {
 		return err
 	}
 
-	if err := i.file.Sync(); err != nil {
-		return err
+	if version == indexVersion {
+		return nil
 	}
 
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if version != 0 {
+		return unsupportedVersion(file, version)
+	}
+
+	legacy, err := os.ReadFile(file.Name())
+
+	if err != nil {
 		return err
 	}
 
-	return i.file.Close()
+	entries := make([]byte, 0, uint64(len(legacy))/legacyEntryWidth*entierWidth)
+	entry := make([]byte, entierWidth)
+
+	for len(legacy) >= int(legacyEntryWidth) {
+		enc.PutUint64(entry[:offsetWidth], uint64(enc.Uint32(legacy[:legacyOffsetWidth])))
+		copy(entry[offsetWidth:], legacy[legacyOffsetWidth:legacyEntryWidth])
+
+		entries = append(entries, entry...)
+		legacy = legacy[legacyEntryWidth:]
+	}
+
+	if len(entries) > 0 {
+		log.Printf("migrating index %s to version %d", file.Name(), indexVersion)
+	}
+
+	return writeHeader(file, indexMagic, indexVersion, entries)
 }
 
-func (i *index) Read(offset int64) (uint32, uint64, error) {
+func (i *index) Read(offset int64) (uint64, uint64, error) {
 	if i.size == 0 {
 		return 0, 0, io.EOF
 	}
 
-	var out uint64
+	out := uint64(offset)
 
 	if offset == -1 {
-		out = uint64(i.size/entierWidth - 1)
-	} else {
-		out = uint64(offset)
+		out = i.Entries() - 1
 	}
 
-	if isOffsetOutOfRange := i.size < ((out + 1) * entierWidth); isOffsetOutOfRange {
+	entry := i.entry(out)
+
+	if entry == nil {
 		return 0, 0, io.EOF
 	}
 
-	offsetStartsAt := out * entierWidth
-	offsetEndsAt := offsetStartsAt + offsetWidth
+	return enc.Uint64(entry[:offsetWidth]), enc.Uint64(entry[offsetWidth:]), nil
+}
+
+// Find returns the position stored for the relative offset, or io.EOF when
+// the index has no entry for it. Entries are looked up directly while the
+// offsets are dense and by binary search once compaction has left gaps.
+func (i *index) Find(offset uint64) (uint64, error) {
+	if out, pos, err := i.Read(int64(offset)); err == nil && out == offset {
+		return pos, nil
+	}
+
+	entry := sort.Search(int(i.Entries()), func(entry int) bool {
+		out, _, _ := i.Read(int64(entry))
+		return out >= offset
+	})
 
-	posStartsAt := offsetEndsAt
-	posEndsAt := posStartsAt + posWidth
+	out, pos, err := i.Read(int64(entry))
 
-	outOffset := enc.Uint32(i.mmap[offsetStartsAt:offsetEndsAt])
-	pos := enc.Uint64(i.mmap[posStartsAt:posEndsAt])
+	if err != nil || out != offset {
+		return 0, io.EOF
+	}
 
-	return outOffset, pos, nil
+	return pos, nil
 }
 
-func (i *index) Write(offset uint32, pos uint64) error {
-	if isSpaceNotAvaliable := uint64(len(i.mmap)) < (i.size)+(entierWidth); isSpaceNotAvaliable {
-		return io.EOF
+// Floor returns the entry with the greatest relative offset not above offset,
+// or io.EOF when every entry is above it.
+func (i *index) Floor(offset uint64) (uint64, uint64, error) {
+	if out, pos, err := i.Read(int64(offset)); err == nil && out == offset {
+		return out, pos, nil
 	}
 
-	offsetStartsAt := i.size
-	offsetEndsAt := i.size + offsetWidth
+	entry := sort.Search(int(i.Entries()), func(entry int) bool {
+		out, _, _ := i.Read(int64(entry))
+		return out > offset
+	})
 
-	posStartsAt := offsetEndsAt
-	posEndsAt := posStartsAt + posWidth
+	if entry == 0 {
+		return 0, 0, io.EOF
+	}
 
-	enc.PutUint32(i.mmap[offsetStartsAt:offsetEndsAt], offset)
-	enc.PutUint64(i.mmap[posStartsAt:posEndsAt], pos)
+	return i.Read(int64(entry - 1))
+}
 
-	i.size += entierWidth
-	return nil
+func (i *index) Write(offset uint64, pos uint64) error {
+	return i.write(offset, pos, i.limit)
 }
 
-func (i *index) Name() string {
-	return i.file.Name()
+// writeRecovered writes an entry even past the limit of the index, like an
+// index migrated from a denser layout may already be. Recovery uses it, so
+// frames that passed their checksum are indexed rather than truncated.
+func (i *index) writeRecovered(offset uint64, pos uint64) error {
+	return i.write(offset, pos, math.MaxUint64)
+}
+
+func (i *index) write(offset uint64, pos uint64, limit uint64) error {
+	entry, err := i.append(limit)
+
+	if err != nil {
+		return err
+	}
+
+	enc.PutUint64(entry[:offsetWidth], offset)
+	enc.PutUint64(entry[offsetWidth:], pos)
+
+	return nil
 }
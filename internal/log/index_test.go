@@ -30,7 +30,7 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, f.Name(), index.Name())
 
 	entries := []struct {
-		Offset uint32
+		Offset uint64
 		Pos    uint64
 	}{
 		{Offset: 0, Pos: 0},
@@ -70,6 +70,130 @@ func TestIndex(t *testing.T) {
 
 	require.NoError(t, err)
 
-	require.Equal(t, uint32(1), offset)
+	require.Equal(t, uint64(1), offset)
 	require.Equal(t, uint64(10), pos)
 }
+
+func TestIndexGrows(t *testing.T) {
+	f, err := os.CreateTemp("", "index_grow_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 64 * 1024
+
+	index, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(initialMapBytes), fi.Size())
+
+	entries := c.Segment.MaxIndexBytes / entierWidth
+	require.Equal(t, entries, index.Remaining())
+
+	for off := uint64(0); off < entries; off++ {
+		require.NoError(t, index.Write(off, off*10))
+	}
+
+	require.Equal(t, io.EOF, index.Write(entries, 0))
+	require.Zero(t, index.Remaining())
+
+	fi, err = f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, int64(fileHeaderWidth+c.Segment.MaxIndexBytes), fi.Size())
+
+	for _, off := range []uint64{0, entries / 2, entries - 1} {
+		out, pos, err := index.Read(int64(off))
+		require.NoError(t, err)
+		require.Equal(t, off, out)
+		require.Equal(t, off*10, pos)
+	}
+
+	require.NoError(t, index.Close())
+}
+
+func TestIndexMigrateLegacy(t *testing.T) {
+	f, err := os.CreateTemp("", "index_migrate_test")
+
+	require.NoError(t, err)
+
+	defer os.Remove(f.Name())
+
+	// Version 1 entries: 4 byte relative offset followed by 8 byte position
+	legacy := make([]byte, 2*legacyEntryWidth)
+
+	enc.PutUint32(legacy[legacyEntryWidth:], 1)
+	enc.PutUint64(legacy[legacyEntryWidth+legacyOffsetWidth:], 10)
+
+	_, err = f.Write(legacy)
+
+	require.NoError(t, err)
+
+	c := Config{}
+
+	c.Segment.MaxIndexBytes = 1024
+
+	index, err := newIndex(f, c)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), index.Entries())
+
+	offset, pos, err := index.Read(-1)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), offset)
+	require.Equal(t, uint64(10), pos)
+
+	// Relative offsets past the 32 bit range are kept intact
+	require.NoError(t, index.Write(1<<40, 20))
+
+	pos, err = index.Find(1 << 40)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), pos)
+
+	require.NoError(t, index.Close())
+
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+
+	version, err := readHeader(f, indexMagic)
+
+	require.NoError(t, err)
+	require.Equal(t, indexVersion, version)
+
+	fi, err := f.Stat()
+
+	require.NoError(t, err)
+	require.Equal(t, int64(fileHeaderWidth+3*entierWidth), fi.Size())
+	require.NoError(t, f.Close())
+}
+
+func TestIndexGrowFailure(t *testing.T) {
+	f, err := os.CreateTemp("", "index_grow_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1 << 20
+
+	index, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer index.mmap.Unmap()
+
+	// Growing fails once the file can no longer be resized, the entries
+	// already written stay readable.
+	require.NoError(t, f.Close())
+
+	for off := uint64(0); err == nil; off++ {
+		err = index.Write(off, off*entierWidth)
+	}
+
+	require.ErrorIs(t, err, os.ErrClosed)
+	require.Equal(t, (initialMapBytes-fileHeaderWidth)/entierWidth, index.Entries())
+
+	off, pos, err := index.Read(-1)
+	require.NoError(t, err)
+	require.Equal(t, index.Entries()-1, off)
+	require.Equal(t, off*entierWidth, pos)
+}
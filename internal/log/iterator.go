@@ -0,0 +1,117 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"slices"
+
+	api "distributed-services-in-go/api/v1"
+)
+
+// Iterator reads the records of a log in offset order, walking the stores of
+// its segments frame by frame instead of looking every offset up.
+type Iterator struct {
+	log     *Log
+	segment *segment
+	pos     uint64
+	next    uint64
+	pending []*api.Record
+}
+
+// Iterator returns an iterator starting at the first record at or after from.
+func (l *Log) Iterator(from uint64) *Iterator {
+	return &Iterator{log: l, next: from}
+}
+
+// Next returns the next record. At the end of the log it returns io.EOF; the
+// iterator stays usable, and a later call returns the records appended since.
+// Records removed from under the iterator, by Truncate, retention or
+// compaction, are skipped.
+func (it *Iterator) Next() (*api.Record, error) {
+	it.log.mu.RLock()
+	defer it.log.mu.RUnlock()
+
+	for {
+		if it.segment == nil || it.segment.closed {
+			if err := it.seek(); err != nil {
+				return nil, err
+			}
+		}
+
+		for len(it.pending) > 0 {
+			record := it.pending[0]
+			it.pending = it.pending[1:]
+
+			if record.Offset >= it.next {
+				it.next = record.Offset + 1
+				return record, nil
+			}
+		}
+
+		if it.pos < it.segment.store.size {
+			records, size, err := it.segment.readFrame(it.pos)
+
+			if errors.Is(err, errCorruptFrame) {
+				return nil, api.ErrCorruptRecord{Offset: it.next}
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			it.pos += size
+			it.pending = records
+
+			continue
+		}
+
+		i := slices.Index(it.log.segments, it.segment)
+
+		if i == len(it.log.segments)-1 {
+			return nil, io.EOF
+		}
+
+		it.segment = it.log.segments[i+1]
+		it.pos = it.segment.store.start
+	}
+}
+
+// Offset returns the offset the iterator continues at.
+func (it *Iterator) Offset() uint64 {
+	return it.next
+}
+
+// seek positions the iterator at the frame holding it.next, or the nearest one
+// before it. Callers must hold the read lock.
+func (it *Iterator) seek() error {
+	l := it.log
+	it.pending = nil
+
+	s := l.segmentFrom(it.next)
+
+	// The offset was removed, continue with the segment after it, or wait at
+	// the end of the log for it to be appended.
+	if s == nil {
+		s = l.activeSegment
+	} else if s.baseOffset > it.next {
+		it.next = s.baseOffset
+	}
+
+	if s.closed {
+		return os.ErrClosed
+	}
+
+	it.segment = s
+	it.pos = s.store.start
+
+	if it.next < s.baseOffset {
+		return nil
+	}
+
+	if _, pos, err := s.index.Floor(it.next - s.baseOffset); err == nil {
+		it.pos = pos
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package log
+
+import (
+	"io"
+	"testing"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, c Config){
+		"plain":      func(t *testing.T, c Config) { testIterator(t, c) },
+		"compressed": func(t *testing.T, c Config) { c.Compression.Codec = GzipCodec{}; testIterator(t, c) },
+		"sparse":     func(t *testing.T, c Config) { c.Segment.IndexIntervalBytes = 64; testIterator(t, c) },
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxStoreBytes = 100
+			c.Segment.MaxIndexBytes = entierWidth * 4
+			fn(t, c)
+		})
+	}
+}
+
+func testIterator(t *testing.T, c Config) {
+	log := newTestLog(t, c)
+
+	appendRecords := func(n int) {
+		t.Helper()
+
+		for i := 0; i < n; i++ {
+			_, _, err := log.AppendBatch([]*api.Record{
+				{Value: []byte("hello world")},
+				{Value: []byte("hello world")},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	requireNext := func(it *Iterator, from, to uint64) {
+		t.Helper()
+
+		for off := from; off < to; off++ {
+			record, err := it.Next()
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, []byte("hello world"), record.Value)
+		}
+
+		_, err := it.Next()
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, to, it.Offset())
+	}
+
+	appendRecords(5)
+	require.Greater(t, len(log.segments), 2)
+
+	it := log.Iterator(0)
+	requireNext(it, 0, 10)
+
+	// Records appended after the end was reached show up.
+	appendRecords(1)
+	requireNext(it, 10, 12)
+
+	// Starting in the middle of a segment and of a batch.
+	requireNext(log.Iterator(5), 5, 12)
+
+	// Truncate removes the segment the iterator is in.
+	it = log.Iterator(0)
+	_, err := it.Next()
+	require.NoError(t, err)
+
+	require.NoError(t, log.Truncate(4))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Greater(t, lowest, uint64(1))
+
+	requireNext(it, lowest, 12)
+}
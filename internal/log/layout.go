@@ -0,0 +1,104 @@
+package log
+
+import (
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// segmentFileName matches the files of a segment, named after its base offset
+// in canonical decimal form. Anything else in the directory is left alone.
+var segmentFileName = regexp.MustCompile(`^(0|[1-9][0-9]*)\.(store|index|timeindex)$`)
+
+// discover returns the sorted base offsets of the segments in l.Dir, found
+// through their store files, and the index files whose store is missing.
+func (l *Log) discover() ([]uint64, []string, error) {
+	files, err := os.ReadDir(l.Dir)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stores := map[uint64]bool{}
+	indexes := map[uint64][]string{}
+
+	for _, file := range files {
+		match := segmentFileName.FindStringSubmatch(file.Name())
+
+		if match == nil || !file.Type().IsRegular() {
+			continue
+		}
+
+		off, err := strconv.ParseUint(match[1], 10, 64)
+
+		if err != nil {
+			continue
+		}
+
+		// A segment is discovered through its store, its indexes are opened
+		// or rebuilt from the store by newSegment.
+		if match[2] == "store" {
+			stores[off] = true
+		} else {
+			indexes[off] = append(indexes[off], file.Name())
+		}
+	}
+
+	baseOffsets := []uint64{}
+
+	for off := range stores {
+		baseOffsets = append(baseOffsets, off)
+	}
+
+	orphans := []string{}
+
+	for off, names := range indexes {
+		if !stores[off] {
+			orphans = append(orphans, names...)
+		}
+	}
+
+	slices.Sort(baseOffsets)
+	slices.Sort(orphans)
+
+	return baseOffsets, orphans, nil
+}
+
+// reportOrphans records the orphaned index files of the log. They are never
+// paired with another segment's store; a segment later created at their base
+// offset starts with an empty store and drops their entries on open.
+func (l *Log) reportOrphans(orphans []string) {
+	l.Orphans = nil
+
+	for _, name := range orphans {
+		l.Orphans = append(l.Orphans, path.Join(l.Dir, name))
+	}
+
+	if l.Config.ReadOnly {
+		return
+	}
+
+	for _, name := range l.Orphans {
+		log.Printf("orphaned segment file %s", name)
+	}
+}
+
+// syncDir fsyncs dir, so the files renamed into or removed from it stay that
+// way after a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+
+	if err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
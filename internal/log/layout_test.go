@@ -0,0 +1,47 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoverTolerant(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	log := newTestLog(t, c)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Close())
+
+	for _, name := range []string{".DS_Store", "notes.txt", "store", "01.store", "2.store.tmp", "18446744073709551616.store"} {
+		require.NoError(t, os.WriteFile(path.Join(log.Dir, name), []byte("stray"), 0644))
+	}
+
+	require.NoError(t, os.Mkdir(path.Join(log.Dir, "5.store"), 0755))
+
+	// Index files left behind by a segment whose store is gone.
+	require.NoError(t, os.WriteFile(path.Join(log.Dir, "9.index"), nil, 0644))
+	require.NoError(t, os.WriteFile(path.Join(log.Dir, "9.timeindex"), nil, 0644))
+
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Len(t, log.segments, 2)
+	require.Equal(t, []string{path.Join(log.Dir, "9.index"), path.Join(log.Dir, "9.timeindex")}, log.Orphans)
+
+	for off := uint64(0); off < 3; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+}
@@ -0,0 +1,53 @@
+package log
+
+import (
+	"errors"
+	"os"
+	"path"
+)
+
+// lockFileName is the file in Log.Dir a writer holds an exclusive lock on.
+const lockFileName = "LOCK"
+
+var (
+	// ErrLocked is returned when another process has the log open for writing.
+	ErrLocked = errors.New("log directory is locked by another process")
+	// ErrReadOnly is returned when modifying a log opened with Config.ReadOnly.
+	ErrReadOnly = errors.New("log is opened read-only")
+)
+
+// lock takes the exclusive lock on the log directory. It is held until unlock,
+// so a second writer opening the same directory fails with ErrLocked.
+func (l *Log) lock() error {
+	if l.lockFile != nil {
+		return nil
+	}
+
+	file, err := os.OpenFile(path.Join(l.Dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.lockFile = file
+
+	return nil
+}
+
+// unlock releases the directory lock. The lock file itself stays in place, as
+// removing it could race with another process taking the lock.
+func (l *Log) unlock() error {
+	if l.lockFile == nil {
+		return nil
+	}
+
+	err := l.lockFile.Close()
+	l.lockFile = nil
+
+	return err
+}
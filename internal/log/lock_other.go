@@ -0,0 +1,11 @@
+//go:build !unix
+
+package log
+
+import "os"
+
+// lockFile does nothing where flock is not available; the lock file is still
+// created so the layout of the directory does not depend on the platform.
+func lockFile(file *os.File) error {
+	return nil
+}
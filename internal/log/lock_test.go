@@ -0,0 +1,106 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	c := Config{}
+	c.Sync.Policy = SyncEveryAppend
+	writer := newTestLog(t, c)
+
+	_, err := writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	_, err = NewLog(writer.Dir, c)
+	require.ErrorIs(t, err, ErrLocked)
+
+	c.ReadOnly = true
+	reader, err := NewLog(writer.Dir, c)
+	require.NoError(t, err)
+
+	got, err := reader.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), got.Value)
+
+	_, err = reader.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, reader.Truncate(0))
+	require.Equal(t, ErrReadOnly, reader.Remove())
+
+	require.NoError(t, reader.Close())
+	require.NoError(t, writer.Close())
+
+	c.ReadOnly = false
+	writer, err = NewLog(writer.Dir, c)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+}
+
+func TestReadOnlyLeavesFilesAlone(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	log := newTestLog(t, c)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Close())
+
+	// Leave a torn frame and a stale index behind, as a crash would.
+	store := path.Join(log.Dir, "2.store")
+	f, err := os.OpenFile(store, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Remove(path.Join(log.Dir, "2.index")))
+	require.NoError(t, os.WriteFile(path.Join(log.Dir, "2.index"), nil, 0644))
+
+	// Index files can be missing altogether, like halfway through compaction.
+	require.NoError(t, os.Remove(path.Join(log.Dir, "0.index")))
+	require.NoError(t, os.Remove(path.Join(log.Dir, "0.timeindex")))
+
+	snapshot := func() map[string]int64 {
+		entries, err := os.ReadDir(log.Dir)
+		require.NoError(t, err)
+
+		sizes := map[string]int64{}
+
+		for _, entry := range entries {
+			fi, err := entry.Info()
+			require.NoError(t, err)
+			sizes[entry.Name()] = fi.Size()
+		}
+
+		return sizes
+	}
+
+	before := snapshot()
+
+	c.ReadOnly = true
+	reader, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.Empty(t, reader.Repairs)
+
+	for off := uint64(0); off < 3; off++ {
+		got, err := reader.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+	}
+
+	highest, err := reader.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+
+	require.NoError(t, reader.Close())
+	require.Equal(t, before, snapshot())
+}
@@ -0,0 +1,21 @@
+//go:build unix
+
+package log
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile takes a non-blocking exclusive flock on file. The lock belongs to
+// the open file, so closing it releases the lock.
+func lockFile(file *os.File) error {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrLocked
+	}
+
+	return err
+}
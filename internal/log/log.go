@@ -1,13 +1,15 @@
 package log
 
 import (
+	"fmt"
+	"hash/crc32"
 	"io"
+	"log"
 	"os"
 	"path"
-	"slices"
-	"strconv"
-	"strings"
+	"sort"
 	"sync"
+	"time"
 
 	api "distributed-services-in-go/api/v1"
 )
@@ -15,10 +17,45 @@ import (
 type Log struct {
 	mu sync.RWMutex
 
+	// maintenanceMu keeps retention, compaction, Truncate, Refresh and
+	// snapshots from removing or rewriting segments under each other.
+	maintenanceMu sync.Mutex
+
 	Dir           string
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	cache         segmentCache
+
+	// Repairs lists the segments that had to be repaired when the log was
+	// opened after an unclean shutdown.
+	Repairs []Repair
+
+	// Metadata describes the directory, as read when the log was opened.
+	Metadata Metadata
+
+	// Orphans lists the index files found without the store of their segment
+	// when the log was opened.
+	Orphans []string
+
+	queueMu    sync.Mutex
+	queue      []*pendingAppend
+	committing bool
+
+	unsynced uint64
+	pending  *syncBatch
+
+	lastTimestamp int64
+
+	// appended is closed and replaced whenever new records become readable,
+	// waking the Wait calls blocked on it.
+	appended chan struct{}
+
+	// lockFile holds the directory lock of a writer.
+	lockFile *os.File
+
+	done chan struct{}
+	wg   sync.WaitGroup
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -30,9 +67,20 @@ func NewLog(dir string, c Config) (*Log, error) {
 		c.Segment.MaxIndexBytes = 1024
 	}
 
+	if c.Sync.Policy == SyncInterval && c.Sync.Interval == 0 {
+		c.Sync.Interval = defaultSyncInterval
+	}
+
+	hasRetention := c.Retention.MaxBytes > 0 || c.Retention.MaxAge > 0 || c.Retention.LowestOffset > 0
+
+	if hasRetention && c.Retention.Interval == 0 {
+		c.Retention.Interval = defaultRetentionInterval
+	}
+
 	log := &Log{Dir: dir, Config: c}
 
 	if err := log.setup(); err != nil {
+		log.unlock()
 		return nil, err
 	}
 
@@ -40,31 +88,52 @@ func NewLog(dir string, c Config) (*Log, error) {
 }
 
 func (l *Log) setup() error {
-
-	files, err := os.ReadDir(l.Dir)
-
-	if err != nil {
+	if err := l.open(); err != nil {
 		return err
 	}
 
-	baseOffsets := []uint64{}
+	l.startBackground()
 
-	for _, file := range files {
-		offstr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
+	return nil
+}
 
-		off, err := strconv.ParseUint(offstr, 10, 0)
+// open opens the segments found in the directory, finishing a committed
+// restore first. It leaves the background work to setup.
+func (l *Log) open() error {
+	l.Repairs = nil
+	l.cache.reset()
+	l.notifyAppended()
 
-		if err != nil {
+	if !l.Config.ReadOnly {
+		if err := l.lock(); err != nil {
+			return err
+		}
+
+		if err := finishRestore(l.Dir); err != nil {
 			return err
 		}
 
-		baseOffsets = append(baseOffsets, off)
+		for _, dir := range []string{compactDir, restoreDir} {
+			if err := os.RemoveAll(path.Join(l.Dir, dir)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := l.setupMetadata(); err != nil {
+		return err
 	}
 
-	slices.Sort(baseOffsets)
+	baseOffsets, orphans, err := l.discover()
 
-	for i := 0; i < len(baseOffsets); i += 2 {
-		err := l.newSegment(baseOffsets[i])
+	if err != nil {
+		return err
+	}
+
+	l.reportOrphans(orphans)
+
+	for _, baseOffset := range baseOffsets {
+		err := l.newSegment(baseOffset)
 
 		if err != nil {
 			return err
@@ -72,6 +141,17 @@ func (l *Log) setup() error {
 
 	}
 
+	// Compaction may have removed the newest records of a closed segment, so
+	// its range ends where the next segment starts.
+	for i := 1; i < len(l.segments); i++ {
+		l.segments[i-1].nextOffset = l.segments[i].baseOffset
+		mapClosed(l.segments[i-1])
+	}
+
+	if l.segments == nil && l.Config.ReadOnly {
+		return fmt.Errorf("%s: no segments to read", l.Dir)
+	}
+
 	if l.segments == nil {
 		err := l.newSegment(l.Config.Segment.InitialOffset)
 
@@ -82,6 +162,73 @@ func (l *Log) setup() error {
 
 	return nil
 }
+
+func (l *Log) startBackground() {
+	l.done = make(chan struct{})
+
+	if l.Config.ReadOnly {
+		if l.Config.Follow.Interval > 0 {
+			l.every(l.Config.Follow.Interval, l.refresh)
+		}
+
+		return
+	}
+
+	if l.Config.Sync.Policy == SyncInterval {
+		l.every(l.Config.Sync.Interval, l.syncPending)
+	}
+
+	if l.Config.Retention.Interval > 0 {
+		l.every(l.Config.Retention.Interval, l.clean)
+	}
+
+	if l.Config.Compaction.Interval > 0 {
+		l.every(l.Config.Compaction.Interval, l.compact)
+	}
+
+	if l.Config.Segment.MaxAge > 0 {
+		l.every(min(l.Config.Segment.MaxAge, time.Second), l.rollExpired)
+	}
+
+	if l.Config.Upgrade.Background && l.needsUpgrade() {
+		l.upgrade()
+	}
+}
+
+// every runs fn every interval until the log is closed.
+func (l *Log) every(interval time.Duration, fn func()) {
+	done := l.done
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+
+			case <-ticker.C:
+				fn()
+			}
+		}
+	}()
+}
+
+func (l *Log) stopBackground() {
+	if l.done == nil {
+		return
+	}
+
+	close(l.done)
+	l.wg.Wait()
+	l.done = nil
+}
+
 func (l *Log) newSegment(baseOffset uint64) error {
 	s, err := newSegment(l.Dir, baseOffset, l.Config)
 
@@ -89,6 +236,18 @@ func (l *Log) newSegment(baseOffset uint64) error {
 		return err
 	}
 
+	// A read-only log only repairs its view of the segment, there is nothing
+	// to report.
+	if !s.repair.IsEmpty() && !l.Config.ReadOnly {
+		log.Printf("repaired segment %d: %+v", s.repair.BaseOffset, s.repair)
+
+		l.Repairs = append(l.Repairs, s.repair)
+	}
+
+	if s.maxTimestamp > l.lastTimestamp {
+		l.lastTimestamp = s.maxTimestamp
+	}
+
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 
@@ -96,36 +255,144 @@ func (l *Log) newSegment(baseOffset uint64) error {
 }
 
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	off, _, err := l.AppendBatch([]*api.Record{record})
 
-	off, err := l.activeSegment.Append(record)
+	return off, err
+}
+
+// AppendBatch appends records at contiguous offsets and returns the first and
+// last of them. Either every record is written or none is.
+func (l *Log) AppendBatch(records []*api.Record) (uint64, uint64, error) {
+	if l.Config.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+
+	if len(records) == 0 {
+		return 0, 0, api.ErrEmptyBatch{}
+	}
+
+	p := &pendingAppend{records: records}
+
+	l.enqueue(p)
+
+	if p.err != nil {
+		return 0, 0, p.err
+	}
+
+	if p.batch != nil {
+		<-p.batch.done
+
+		if p.batch.err != nil {
+			return 0, 0, p.batch.err
+		}
+	}
+
+	return p.off, p.off + uint64(len(records)) - 1, nil
+}
+
+// append writes records contiguously into the active segment. The segment is
+// rolled first when the records would not fit into its indexes or it has
+// expired, and a failed write is rolled back so no part of the batch is left
+// behind.
+func (l *Log) append(records []*api.Record) (uint64, error) {
+	size := uint64(len(records))
+
+	isEmpty := l.activeSegment.nextOffset == l.activeSegment.baseOffset
+	isFull := size > l.activeSegment.Remaining()
+
+	if (isFull || l.activeSegment.IsExpired(l.Config.Segment.MaxAge)) && !isEmpty {
+		if err := l.roll(); err != nil {
+			return 0, err
+		}
+	}
+
+	if max := l.activeSegment.Remaining(); size > max {
+		return 0, api.ErrBatchTooLarge{Records: size, Max: max}
+	}
+
+	mark := l.activeSegment.mark()
+
+	for _, record := range records {
+		record.Timestamp = l.timestamp()
+	}
+
+	if _, err := l.activeSegment.AppendBatch(records); err != nil {
+		if err := l.activeSegment.rollback(mark); err != nil {
+			return 0, err
+		}
 
-	if err != nil {
 		return 0, err
 	}
 
 	if l.activeSegment.IsMaxed() {
-		if err := l.newSegment(off + 1); err != nil {
+		if err := l.roll(); err != nil {
 			return 0, err
 		}
+	}
 
+	return mark.nextOffset, nil
+}
+
+// rollExpired rolls the active segment once it is older than
+// Config.Segment.MaxAge, so idle logs do not keep one segment open forever.
+func (l *Log) rollExpired() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.activeSegment.IsExpired(l.Config.Segment.MaxAge) {
+		return
 	}
 
-	return off, err
+	if err := l.roll(); err != nil {
+		log.Printf("roll segment %d: %v", l.activeSegment.baseOffset, err)
+	}
+}
+
+// timestamp returns the append time for the next record. It never goes back
+// in time, even when the wall clock does. Callers must hold l.mu.
+func (l *Log) timestamp() int64 {
+	now := time.Now().UnixMilli()
+
+	if now < l.lastTimestamp {
+		now = l.lastTimestamp
+	}
+
+	l.lastTimestamp = now
+
+	return now
+}
+
+func (l *Log) roll() error {
+	if l.Config.Sync.Policy != SyncNever {
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
+
+	closed := l.activeSegment
+
+	if err := l.newSegment(closed.nextOffset); err != nil {
+		return err
+	}
+
+	mapClosed(closed)
+
+	return nil
+}
+
+// mapClosed maps the store of a segment that no longer receives appends. The
+// segment keeps reading from its file if the mapping fails.
+func mapClosed(s *segment) {
+	if err := s.store.Map(); err != nil {
+		log.Printf("map segment %d: %v", s.baseOffset, err)
+	}
 }
 
 func (l *Log) Read(off uint64) (*api.Record, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	var segment *segment
-	for _, s := range l.segments {
-		if s.baseOffset <= off && s.nextOffset > off {
-			segment = s
-			break
-		}
-	}
+	segment := l.segmentFor(off)
 
 	if segment == nil {
 		return nil, api.ErrOffsetOutOfRange{Offset: off}
@@ -134,9 +401,91 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	return segment.Read(off)
 }
 
+// segmentFor returns the segment holding off, or nil when no segment does.
+// Callers must hold l.mu.
+func (l *Log) segmentFor(off uint64) *segment {
+	if s := l.cache.get(off); s != nil {
+		return s
+	}
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].nextOffset > off
+	})
+
+	if i == len(l.segments) || l.segments[i].baseOffset > off {
+		return nil
+	}
+
+	l.cache.put(l.segments[i])
+
+	return l.segments[i]
+}
+
+// segmentFrom returns the segment holding off or, when off was removed along
+// with its segment, the first segment after it. It returns nil when off has
+// not been appended yet. Callers must hold l.mu.
+func (l *Log) segmentFrom(off uint64) *segment {
+	if s := l.segmentFor(off); s != nil {
+		return s
+	}
+
+	i := sort.Search(len(l.segments), func(i int) bool {
+		return l.segments[i].baseOffset > off
+	})
+
+	if i == len(l.segments) {
+		return nil
+	}
+
+	return l.segments[i]
+}
+
+// SkipRemoved returns off, or the base offset of the segment after it when
+// retention, compaction or Truncate removed off along with its segment. An
+// offset below the oldest segment skips to LowestOffset.
+func (l *Log) SkipRemoved(off uint64) uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if s := l.segmentFrom(off); s != nil && s.baseOffset > off {
+		return s.baseOffset
+	}
+
+	return off
+}
+
+// OffsetForTime returns the first offset appended at or after t. When every
+// record is older than t it returns the offset the next record will get.
+func (l *Log) OffsetForTime(t time.Time) (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	timestamp := t.UnixMilli()
+
+	for _, s := range l.segments {
+		if s.maxTimestamp >= timestamp {
+			return s.OffsetForTime(timestamp)
+		}
+	}
+
+	return l.activeSegment.nextOffset, nil
+}
+
+// Close closes every segment and releases the directory lock.
 func (l *Log) Close() error {
+	l.stopBackground()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	defer l.unlock()
+
+	if l.Config.Sync.Policy != SyncNever && !l.Config.ReadOnly {
+		if err := l.sync(); err != nil {
+			return err
+		}
+	}
+
+	defer l.notifyAppended()
 
 	for _, segment := range l.segments {
 		if err := segment.Close(); err != nil {
@@ -148,6 +497,10 @@ func (l *Log) Close() error {
 }
 
 func (l *Log) Remove() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
 	if err := l.Close(); err != nil {
 		return err
 	}
@@ -185,6 +538,13 @@ func (l *Log) HighestOffset() (uint64, error) {
 }
 
 func (l *Log) Truncate(lowest uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -201,10 +561,15 @@ func (l *Log) Truncate(lowest uint64) error {
 		segments = append(segments, s)
 	}
 
+	l.cache.reset()
 	l.segments = segments
 	return nil
 }
 
+// Reader streams the store frames of every segment. Encrypted frames are
+// decrypted and framed again, so the stream only holds plaintext frames.
+// Segments changing while it is read show through, Snapshot takes a
+// consistent copy.
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
@@ -212,7 +577,7 @@ func (l *Log) Reader() io.Reader {
 	readers := make([]io.Reader, len(l.segments))
 
 	for i, segment := range l.segments {
-		readers[i] = &orignReader{store: segment.store, off: 0}
+		readers[i] = &orignReader{store: segment.store, keys: segment.config.Encryption.Keys, off: int64(segment.store.start)}
 	}
 
 	return io.MultiReader(readers...)
@@ -220,13 +585,52 @@ func (l *Log) Reader() io.Reader {
 
 type orignReader struct {
 	store *store
+	keys  KeyProvider
 	off   int64
+	buf   []byte
 }
 
 func (o *orignReader) Read(p []byte) (int, error) {
-	n, err := o.store.ReadAt(p, o.off)
+	if len(o.buf) == 0 {
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
 
-	o.off += int64(n)
+	n := copy(p, o.buf)
+	o.buf = o.buf[n:]
 
-	return n, err
+	return n, nil
+}
+
+// next buffers the frame at o.off, decrypting it if needed. Frames of a
+// baseline store are given the checksum they lack. A frame whose length runs
+// past the end of the store returns errCorruptFrame. The reader holds no log
+// lock, so the frame is copied out rather than aliasing the mapping.
+func (o *orignReader) next() error {
+	payload, err := o.store.readCopy(uint64(o.off))
+
+	if err != nil {
+		return err
+	}
+
+	o.off += int64(o.store.frameHeaderWidth()) + int64(len(payload))
+
+	if isEncrypted(payload) {
+		plaintext, err := decryptFrame(o.keys, payload)
+
+		if err != nil {
+			return err
+		}
+
+		payload = plaintext
+	}
+
+	frame := make([]byte, headerWidth, headerWidth+len(payload))
+	enc.PutUint64(frame[:lenWidth], uint64(len(payload)))
+	enc.PutUint32(frame[lenWidth:], crc32.Checksum(payload, crcTable))
+
+	o.buf = append(frame, payload...)
+
+	return nil
 }
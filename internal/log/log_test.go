@@ -2,9 +2,11 @@ package log
 
 import (
 	api "distributed-services-in-go/api/v1"
+	"fmt"
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/protobuf/proto"
@@ -17,6 +19,12 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"corrupt record error":              testCorruptRecordErr,
+		"repair torn tail on open":          testRepairTornTail,
+		"rebuild missing index":             testRebuildMissingIndex,
+		"append batch":                      testAppendBatch,
+		"append batch too large":            testAppendBatchTooLarge,
+		"offset for time":                   testOffsetForTime,
 	}
 	for scenario, fn := range scenarios {
 		t.Run(scenario, func(t *testing.T) {
@@ -92,9 +100,22 @@ func testReader(t *testing.T, log *Log) {
 	b, err := io.ReadAll(reader)
 	require.NoError(t, err)
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(b[headerWidth:], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
+
+	// A corrupt length is caught instead of sizing the frame by it.
+	store := log.segments[0].store
+	length := make([]byte, lenWidth)
+	enc.PutUint64(length, 1<<40)
+	file, err := os.OpenFile(store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = file.WriteAt(length, int64(store.start))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	_, err = io.ReadAll(log.Reader())
+	require.ErrorIs(t, err, errCorruptFrame)
 }
 
 func testTruncate(t *testing.T, log *Log) {
@@ -110,3 +131,294 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testCorruptRecordErr(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(log.segments[0].store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(log.segments[0].store.start+headerWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	read, err := log.Read(off)
+	require.Nil(t, read)
+	apiErr := err.(api.ErrCorruptRecord)
+	require.Equal(t, off, apiErr.Offset)
+}
+
+func testRepairTornTail(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+	require.Empty(t, o.Repairs)
+
+	f, err := os.OpenFile(o.activeSegment.store.Name(), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Equal(t, []Repair{{BaseOffset: o.activeSegment.baseOffset, TruncatedStoreBytes: 11}}, n.Repairs)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testRebuildMissingIndex(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+	require.NoError(t, os.Remove(o.segments[0].index.Name()))
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Len(t, n.segments, len(o.segments))
+	require.Equal(t, uint64(0), n.Repairs[0].BaseOffset)
+	for i := uint64(0); i < 3; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, append.Value, read.Value)
+	}
+}
+
+func testAppendBatch(t *testing.T, log *Log) {
+	records := []*api.Record{}
+	for i := 0; i < 3; i++ {
+		records = append(records, &api.Record{Value: []byte("hello world")})
+	}
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	first, last, err := log.AppendBatch(records)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first)
+	require.Equal(t, uint64(3), last)
+
+	// The batch is kept in one segment even though it is larger than
+	// MaxStoreBytes
+	segment := log.segments[len(log.segments)-2]
+	require.LessOrEqual(t, segment.baseOffset, first)
+	require.Equal(t, last+1, segment.nextOffset)
+
+	for off := first; off <= last; off++ {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+
+	_, _, err = log.AppendBatch(nil)
+	require.Equal(t, api.ErrEmptyBatch{}, err)
+}
+
+func testAppendBatchTooLarge(t *testing.T, log *Log) {
+	max := log.Config.Segment.MaxIndexBytes / entierWidth
+	records := make([]*api.Record, max+1)
+	for i := range records {
+		records[i] = &api.Record{Value: []byte("hello world")}
+	}
+
+	_, _, err := log.AppendBatch(records)
+	require.Equal(t, api.ErrBatchTooLarge{Records: max + 1, Max: max}, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.Equal(t, uint64(1), log.activeSegment.nextOffset)
+}
+
+func testOffsetForTime(t *testing.T, o *Log) {
+	start := time.Now()
+	times := []time.Time{}
+	for i := 0; i < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+		times = append(times, time.Now())
+		off, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		read, err := o.Read(off)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, read.Timestamp, times[i].UnixMilli())
+	}
+
+	off, err := o.OffsetForTime(start)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	for i, at := range times {
+		off, err := o.OffsetForTime(at)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	off, err = o.OffsetForTime(time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+
+	// The time index is rebuilt from the store when it goes missing
+	require.NoError(t, o.Close())
+	require.NoError(t, os.Remove(o.segments[1].timeIndex.Name()))
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n.Repairs[0].RecoveredTimeIndexEntries)
+	off, err = n.OffsetForTime(times[1])
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+}
+
+// newTestLog opens a log with config c in a temporary directory that is removed
+// along with the log when the test ends.
+// newTestLog opens a log under c in a new directory, both cleaned up once
+// the test or benchmark is done.
+func newTestLog(tb testing.TB, c Config) *Log {
+	tb.Helper()
+
+	dir, err := os.MkdirTemp("", "log-test")
+	require.NoError(tb, err)
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+
+	log, err := NewLog(dir, c)
+	require.NoError(tb, err)
+	tb.Cleanup(func() { log.Close() })
+
+	return log
+}
+
+func TestRollExpired(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	o := newTestLog(t, c)
+
+	for i := 0; i < 2; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// Appending to an expired segment rolls it first
+	o.Config.Segment.MaxAge = 20 * time.Millisecond
+	time.Sleep(o.Config.Segment.MaxAge)
+	off, err := o.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Len(t, o.segments, 2)
+	require.Equal(t, off, o.activeSegment.baseOffset)
+	require.NoError(t, o.Close())
+
+	// An idle segment is rolled on a timer, an empty one is left alone
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Eventually(t, func() bool {
+		n.mu.RLock()
+		defer n.mu.RUnlock()
+		return len(n.segments) == 3
+	}, time.Second, time.Millisecond)
+
+	time.Sleep(2 * o.Config.Segment.MaxAge)
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	require.Len(t, n.segments, 3)
+	require.Equal(t, off+1, n.activeSegment.baseOffset)
+}
+
+func TestReadAcrossSegments(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	log := newTestLog(t, c)
+
+	for i := 0; i < 9; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 5)
+
+	// Read out of order so lookups go through both the cache and the search
+	for _, off := range []uint64{8, 0, 5, 5, 1, 7, 2, 8, 3, 6, 4} {
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+
+	require.NoError(t, log.Truncate(3))
+	for _, off := range []uint64{0, 3, 9} {
+		_, err := log.Read(off)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+	}
+}
+
+// newBenchLog opens a log holding a single record in each of segments
+// segments.
+func newBenchLog(b *testing.B, segments int) *Log {
+	b.Helper()
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth
+	log := newTestLog(b, c)
+
+	for i := 0; i < segments; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+	}
+
+	return log
+}
+
+// BenchmarkRead reads records spread over a growing number of segments.
+// Scattered reads land in a different index and store mapping every time, so
+// with more segments they miss the CPU caches and TLB that a tail reader keeps
+// warm. BenchmarkSegmentFor measures the segment lookup on its own.
+func BenchmarkRead(b *testing.B) {
+	for _, segments := range []int{10, 100, 1000} {
+		log := newBenchLog(b, segments)
+
+		b.Run(fmt.Sprintf("segments=%d/scattered", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(i*7919) % uint64(segments)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("segments=%d/tail", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(segments - 1)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSegmentFor looks up the segments of scattered offsets, which miss
+// the cache and go through the binary search.
+func BenchmarkSegmentFor(b *testing.B) {
+	for _, segments := range []int{10, 100, 1000} {
+		log := newBenchLog(b, segments)
+
+		b.Run(fmt.Sprintf("segments=%d", segments), func(b *testing.B) {
+			log.mu.RLock()
+			defer log.mu.RUnlock()
+
+			for i := 0; i < b.N; i++ {
+				if log.segmentFor(uint64(i*7919)%uint64(segments)) == nil {
+					b.Fatal("no segment")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package log
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// initialMapBytes is how much of an index file is mapped when it is opened;
+// the mapping doubles from there as entries are written, so small and idle
+// segments do not pay for MaxIndexBytes up front.
+const initialMapBytes uint64 = 4096
+
+// entryFile is a file of fixed-width entries following a header, mapped into
+// memory and grown as entries are appended. index and timeIndex build on it.
+type entryFile struct {
+	file  *os.File
+	mmap  mmap.MMap
+	size  uint64
+	limit uint64
+	width uint64
+
+	// readOnly entry files work on a private copy of the file and never
+	// write it back.
+	readOnly bool
+}
+
+// openEntryFile maps file, holding size bytes of entries of the given width,
+// with room for MaxIndexBytes of entries. A read-only log cannot create a file
+// that is missing, it passes a nil file and gets an empty entry file.
+func openEntryFile(file *os.File, size, width uint64, config Config) (entryFile, error) {
+	f := entryFile{
+		file:     file,
+		size:     size,
+		limit:    fileHeaderWidth + config.Segment.MaxIndexBytes,
+		width:    width,
+		readOnly: config.ReadOnly,
+	}
+
+	if file == nil {
+		f.mmap = make(mmap.MMap, min(initialMapBytes, f.limit))
+		f.readOnly = true
+
+		return f, nil
+	}
+
+	m, err := mapIndexFile(file, fileHeaderWidth+size, f.limit, f.readOnly)
+
+	if err != nil {
+		log.Printf("mmap.Map %v", err.Error())
+		return entryFile{}, err
+	}
+
+	f.mmap = m
+
+	return f, nil
+}
+
+func (f *entryFile) Close() error {
+	if err := unmap(f.mmap, f.readOnly); err != nil {
+		return err
+	}
+
+	// An append after Close grows a new mapping, failing on the closed file,
+	// instead of writing to the unmapped one.
+	f.mmap = nil
+
+	if f.file == nil {
+		return nil
+	}
+
+	if f.readOnly {
+		return f.file.Close()
+	}
+
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+
+	if err := f.file.Truncate(int64(fileHeaderWidth + f.size)); err != nil {
+		return err
+	}
+
+	return f.file.Close()
+}
+
+// Sync fsyncs the file. The mapping is shared, so that writes its pages back
+// too; unlike a flush of the mapping it does not race with an append that
+// grows it, so the log can sync without holding its lock.
+func (f *entryFile) Sync() error {
+	if f.readOnly {
+		return nil
+	}
+
+	return f.file.Sync()
+}
+
+// entry returns the bytes of entry n, or nil when there is no such entry.
+func (f *entryFile) entry(n uint64) []byte {
+	if f.size < (n+1)*f.width {
+		return nil
+	}
+
+	at := fileHeaderWidth + n*f.width
+
+	return f.mmap[at : at+f.width]
+}
+
+// append adds an entry and returns its bytes to be filled in. The mapping
+// grows up to limit, io.EOF is returned for an entry that does not fit.
+func (f *entryFile) append(limit uint64) ([]byte, error) {
+	m, err := growMap(f.file, f.mmap, fileHeaderWidth+f.size+f.width, limit, f.readOnly)
+
+	if err != nil {
+		return nil, err
+	}
+
+	f.mmap = m
+
+	at := fileHeaderWidth + f.size
+	f.size += f.width
+
+	return f.mmap[at : at+f.width], nil
+}
+
+func (f *entryFile) Truncate(entries uint64) {
+	f.size = entries * f.width
+}
+
+func (f *entryFile) Entries() uint64 {
+	return f.size / f.width
+}
+
+// Remaining returns how many more entries fit into the file.
+func (f *entryFile) Remaining() uint64 {
+	if fileHeaderWidth+f.size >= f.limit {
+		return 0
+	}
+
+	return (f.limit - fileHeaderWidth - f.size) / f.width
+}
+
+func (f *entryFile) Name() string {
+	return f.file.Name()
+}
+
+// mapIndexFile maps file with room for at least used bytes, starting at
+// initialMapBytes but never beyond limit. A read-only index gets a private
+// copy of the first used bytes instead, so entries recovery adds stay in
+// memory.
+func mapIndexFile(file *os.File, used, limit uint64, readOnly bool) (mmap.MMap, error) {
+	size := max(used, min(initialMapBytes, limit))
+
+	if !readOnly {
+		return remap(file, nil, size)
+	}
+
+	m := make(mmap.MMap, size)
+
+	if _, err := file.ReadAt(m[:used], 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// growMap returns a mapping of file with room for need bytes. m is doubled,
+// up to limit, when it is too small; io.EOF is returned when need is beyond
+// limit. m stays valid whenever an error is returned.
+func growMap(file *os.File, m mmap.MMap, need, limit uint64, readOnly bool) (mmap.MMap, error) {
+	if need <= uint64(len(m)) {
+		return m, nil
+	}
+
+	if need > limit {
+		return m, io.EOF
+	}
+
+	size := min(max(uint64(len(m))*2, need), limit)
+
+	if readOnly {
+		return append(m, make(mmap.MMap, size-uint64(len(m)))...), nil
+	}
+
+	return remap(file, m, size)
+}
+
+// unmap releases m unless it is the private copy of a read-only index.
+func unmap(m mmap.MMap, readOnly bool) error {
+	if m == nil || readOnly {
+		return nil
+	}
+
+	return m.Unmap()
+}
+
+// remap resizes file to size and maps it again. m is only released once the
+// new mapping is in place, so it stays usable when growing fails.
+func remap(file *os.File, m mmap.MMap, size uint64) (mmap.MMap, error) {
+	if err := file.Truncate(int64(size)); err != nil {
+		return nil, err
+	}
+
+	grown, err := mmap.Map(file, mmap.RDWR, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if m != nil {
+		if err := m.Unmap(); err != nil {
+			grown.Unmap()
+			return nil, err
+		}
+	}
+
+	return grown, nil
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	// metadataFileName is the file in Log.Dir describing the log.
+	metadataFileName = "META"
+
+	// metadataVersion is the version of the directory layout.
+	metadataVersion uint32 = 1
+)
+
+// Metadata describes a log directory. It is written when a writer first opens
+// the directory and updated with the config of every writer opening it since.
+type Metadata struct {
+	Version   uint32         `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Config    MetadataConfig `json:"config"`
+}
+
+// MetadataConfig is the part of Config that describes how the files in the
+// directory were written.
+type MetadataConfig struct {
+	MaxStoreBytes      uint64        `json:"max_store_bytes"`
+	MaxIndexBytes      uint64        `json:"max_index_bytes"`
+	InitialOffset      uint64        `json:"initial_offset"`
+	MaxAge             time.Duration `json:"max_age"`
+	IndexIntervalBytes uint64        `json:"index_interval_bytes"`
+	SyncPolicy         SyncPolicy    `json:"sync_policy"`
+	CompressionCodec   byte          `json:"compression_codec"`
+	Encrypted          bool          `json:"encrypted"`
+}
+
+func newMetadataConfig(c Config) MetadataConfig {
+	m := MetadataConfig{
+		MaxStoreBytes:      c.Segment.MaxStoreBytes,
+		MaxIndexBytes:      c.Segment.MaxIndexBytes,
+		InitialOffset:      c.Segment.InitialOffset,
+		MaxAge:             c.Segment.MaxAge,
+		IndexIntervalBytes: c.Segment.IndexIntervalBytes,
+		SyncPolicy:         c.Sync.Policy,
+		Encrypted:          c.Encryption.Keys != nil,
+	}
+
+	if c.Compression.Codec != nil {
+		m.CompressionCodec = c.Compression.Codec.ID()
+	}
+
+	return m
+}
+
+// readMetadata returns the metadata of dir. A directory written before the
+// metadata file existed reads as version 0.
+func readMetadata(dir string) (Metadata, error) {
+	data, err := os.ReadFile(path.Join(dir, metadataFileName))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return Metadata{}, nil
+	}
+
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	m := Metadata{}
+
+	if err := json.Unmarshal(data, &m); err != nil {
+		return Metadata{}, fmt.Errorf("%s: %w", metadataFileName, err)
+	}
+
+	if m.Version > metadataVersion {
+		return Metadata{}, fmt.Errorf("%s: unsupported layout version %d", dir, m.Version)
+	}
+
+	return m, nil
+}
+
+// writeMetadata replaces the metadata of dir. It is written to a temporary
+// file first and renamed into place, so a crash leaves the old or the new
+// metadata behind.
+func writeMetadata(dir string, m Metadata) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, metadataFileName+".tmp-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path.Join(dir, metadataFileName))
+}
+
+// setupMetadata reads the metadata of the log and, for a writer, records the
+// current layout version and config.
+func (l *Log) setupMetadata() error {
+	m, err := readMetadata(l.Dir)
+
+	if err != nil {
+		return err
+	}
+
+	if !l.Config.ReadOnly {
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = time.Now().UTC()
+		}
+
+		m.Version = metadataVersion
+		m.Config = newMetadataConfig(l.Config)
+
+		if err := writeMetadata(l.Dir, m); err != nil {
+			return err
+		}
+	}
+
+	l.Metadata = m
+
+	return nil
+}
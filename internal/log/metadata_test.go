@@ -0,0 +1,51 @@
+package log
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetadata(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 4096
+	c.Compression.Codec = GzipCodec{}
+	log := newTestLog(t, c)
+
+	m, err := readMetadata(log.Dir)
+	require.NoError(t, err)
+	require.Equal(t, log.Metadata, m)
+	require.Equal(t, metadataVersion, m.Version)
+	require.False(t, m.CreatedAt.IsZero())
+	require.Equal(t, uint64(4096), m.Config.MaxStoreBytes)
+	require.Equal(t, uint64(1024), m.Config.MaxIndexBytes)
+	require.Equal(t, gzipCodecID, m.Config.CompressionCodec)
+
+	// Reopening keeps the creation time and records the new config.
+	require.NoError(t, log.Close())
+	c.Compression.Codec = nil
+
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.Equal(t, m.CreatedAt, log.Metadata.CreatedAt)
+	require.Zero(t, log.Metadata.Config.CompressionCodec)
+	require.NoError(t, log.Close())
+
+	// A layout from the future is refused.
+	m.Version = metadataVersion + 1
+	require.NoError(t, writeMetadata(log.Dir, m))
+
+	_, err = NewLog(log.Dir, c)
+	require.ErrorContains(t, err, "unsupported layout version")
+
+	entries, err := os.ReadDir(log.Dir)
+	require.NoError(t, err)
+
+	for _, entry := range entries {
+		require.NotContains(t, entry.Name(), ".tmp")
+	}
+
+	require.FileExists(t, path.Join(log.Dir, metadataFileName))
+}
@@ -0,0 +1,304 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Repair describes what was changed while reopening a segment whose tail was
+// left inconsistent by an unclean shutdown.
+type Repair struct {
+	BaseOffset                uint64
+	DroppedIndexEntries       uint64
+	RecoveredRecords          uint64
+	TruncatedStoreBytes       uint64
+	DroppedTimeIndexEntries   uint64
+	RecoveredTimeIndexEntries uint64
+}
+
+func (r Repair) IsEmpty() bool {
+	return r == Repair{BaseOffset: r.BaseOffset}
+}
+
+// recover validates the segment against its store. The index is cut at the
+// first entry that disagrees with the store, entries that point past the end of
+// the store and trailing ones at a frame not holding their record are dropped,
+// complete frames written after the last valid entry are indexed again (only
+// every IndexIntervalBytes for a sparse index), and the store is truncated at
+// the first torn frame. A missing index is rebuilt entirely from the store
+// this way. The store is never truncated to nothing or below a frame
+// the index still vouches for: an unreadable frame there fails the segment
+// instead.
+func (s *segment) recover() (Repair, error) {
+	repair := Repair{BaseOffset: s.baseOffset}
+
+	entries, err := s.consistentEntries()
+
+	if err != nil {
+		return repair, err
+	}
+
+	// Frames up to the last entry holding its record were written in full,
+	// only what follows them can be a torn tail.
+	indexedEnd, _, err := s.indexedEnd(s.index.Entries())
+
+	if err != nil {
+		return repair, err
+	}
+
+	end, next, err := s.indexedEnd(entries)
+
+	if err != nil {
+		return repair, err
+	}
+
+	repair.DroppedIndexEntries = s.index.Entries() - entries
+	s.index.Truncate(entries)
+
+	for end < s.store.size {
+		records, size, err := s.readFrame(end)
+
+		isInvalid := errors.Is(err, errCorruptFrame) || (err == nil && records[0].Offset < next)
+
+		if isInvalid && end < indexedEnd {
+			return repair, fmt.Errorf("%s: frame at %d is unreadable but later frames are indexed: %w", s.store.Name(), end, errCorruptFrame)
+		}
+
+		if isInvalid && end == s.store.start {
+			if err := s.checkTorn(end); err != nil {
+				return repair, err
+			}
+		}
+
+		if isInvalid {
+			break
+		}
+
+		if err != nil {
+			return repair, err
+		}
+
+		// A full index grows instead, the segment then counts as maxed. The
+		// frame is valid, truncating it would lose records.
+		if s.needsIndexEntry(end) {
+			if err := s.index.writeRecovered(records[0].Offset-s.baseOffset, end); err != nil {
+				return repair, err
+			}
+
+			repair.RecoveredRecords++
+		}
+
+		end += size
+		next = records[len(records)-1].Offset + 1
+	}
+
+	if end < s.store.size {
+		repair.TruncatedStoreBytes = s.store.size - end
+
+		if s.config.ReadOnly {
+			s.store.limit(end)
+		} else if err := s.store.Truncate(end); err != nil {
+			return repair, err
+		}
+	}
+
+	s.nextOffset = next
+
+	if err := s.recoverTimeIndex(&repair); err != nil {
+		return repair, err
+	}
+
+	return repair, nil
+}
+
+// checkTorn returns an error unless the frame at pos runs past the end of the
+// store, as a frame whose append was cut short does. Anything else found where
+// the records should start is corruption that truncating would only hide.
+func (s *segment) checkTorn(pos uint64) error {
+	torn, err := s.store.isTorn(pos)
+
+	if err != nil {
+		return err
+	}
+
+	if !torn {
+		return fmt.Errorf("%s: first frame is unreadable, not truncating the store: %w", s.store.Name(), errCorruptFrame)
+	}
+
+	return nil
+}
+
+// recoverTimeIndex keeps the leading time index entries that are sorted and
+// point at records in the segment, then scans the frames from the last kept
+// entry on to index the timestamps of the records appended after it.
+func (s *segment) recoverTimeIndex(repair *Repair) error {
+	records := s.nextOffset - s.baseOffset
+
+	var entries uint64
+	var prevTimestamp int64
+	var prevOffset uint64
+
+	for ; entries < s.timeIndex.Entries(); entries++ {
+		timestamp, offset, err := s.timeIndex.Read(entries)
+
+		if err != nil {
+			return err
+		}
+
+		isOutOfOrder := timestamp <= prevTimestamp || (entries > 0 && offset <= prevOffset)
+
+		if isOutOfOrder || offset >= records {
+			break
+		}
+
+		prevTimestamp, prevOffset = timestamp, offset
+	}
+
+	repair.DroppedTimeIndexEntries = s.timeIndex.Entries() - entries
+	s.timeIndex.Truncate(entries)
+	s.maxTimestamp = prevTimestamp
+
+	from := uint64(0)
+
+	if entries > 0 {
+		from = prevOffset + 1
+	}
+
+	_, pos, err := s.index.Floor(from)
+
+	// Compaction may have removed the records the index would start with.
+	if err == io.EOF {
+		pos, err = s.store.start, nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for pos < s.store.size {
+		frame, size, err := s.readFrame(pos)
+
+		if errors.Is(err, errCorruptFrame) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Records up to the last kept entry are indexed already, and so is
+		// the frame holding it.
+		first := frame[0].Offset - s.baseOffset
+		_, indexedPos, err := s.index.Floor(first)
+		indexed := err == nil && indexedPos == pos && first >= from
+
+		for len(frame) > 0 && frame[0].Offset-s.baseOffset < from {
+			frame = frame[1:]
+		}
+
+		written, err := s.indexTimestamps(frame, indexed, s.timeIndex.writeRecovered)
+
+		if err != nil {
+			return err
+		}
+
+		repair.RecoveredTimeIndexEntries += written
+		pos += size
+	}
+
+	return nil
+}
+
+// consistentEntries returns the number of leading index entries that describe
+// increasing offsets at increasing positions inside the store, up to the last
+// of them pointing at a frame that holds the record it claims. Only the tail is
+// read back from the store, an unclean shutdown leaves the entries before it
+// alone, so opening a segment does not cost a read of all of it.
+func (s *segment) consistentEntries() (uint64, error) {
+	var prevOffset uint64
+	var prevPos uint64
+
+	entries := s.index.Entries()
+
+	for i := uint64(0); i < entries; i++ {
+		offset, pos, err := s.index.Read(int64(i))
+
+		if err != nil {
+			return 0, err
+		}
+
+		isFirstMisplaced := i == 0 && pos != s.store.start
+		isOutOfOrder := i > 0 && (offset <= prevOffset || pos <= prevPos)
+
+		if isFirstMisplaced || isOutOfOrder || pos >= s.store.size {
+			entries = i
+			break
+		}
+
+		prevOffset, prevPos = offset, pos
+	}
+
+	for ; entries > 0; entries-- {
+		holdsRecord, _, _, err := s.checkEntry(entries - 1)
+
+		if err != nil {
+			return 0, err
+		}
+
+		if holdsRecord {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+// indexedEnd looks through the first entries index entries for the last one
+// holding its record, and returns where its frame ends and the offset after
+// it. Without one, the records start at the beginning of the store.
+func (s *segment) indexedEnd(entries uint64) (uint64, uint64, error) {
+	for ; entries > 0; entries-- {
+		holdsRecord, end, next, err := s.checkEntry(entries - 1)
+
+		if err != nil {
+			return 0, 0, err
+		}
+
+		if holdsRecord {
+			return end, next, nil
+		}
+	}
+
+	return s.store.start, s.baseOffset, nil
+}
+
+// checkEntry reports whether index entry i points at a frame holding the record
+// it claims, and returns where the frame ends and the offset after it.
+func (s *segment) checkEntry(i uint64) (bool, uint64, uint64, error) {
+	offset, pos, err := s.index.Read(int64(i))
+
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	if pos < s.store.start || pos >= s.store.size {
+		return false, 0, 0, nil
+	}
+
+	records, size, err := s.readFrame(pos)
+
+	if errors.Is(err, errCorruptFrame) {
+		return false, 0, 0, nil
+	}
+
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	if records[0].Offset != s.baseOffset+offset {
+		return false, 0, 0, nil
+	}
+
+	return true, pos + size, records[len(records)-1].Offset + 1, nil
+}
@@ -0,0 +1,130 @@
+package log
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+const defaultRetentionInterval = time.Minute
+
+// RetentionReason names the retention limit that caused a segment to be removed.
+type RetentionReason string
+
+const (
+	RetentionBytes  RetentionReason = "bytes"
+	RetentionAge    RetentionReason = "age"
+	RetentionOffset RetentionReason = "offset"
+)
+
+// Removal describes a segment deleted by the retention cleaner.
+type Removal struct {
+	BaseOffset uint64
+	NextOffset uint64
+	Bytes      uint64
+	Reason     RetentionReason
+}
+
+// Clean removes the oldest closed segments that fall outside the retention
+// limits of the log's Config and returns what was removed.
+func (l *Log) Clean() ([]Removal, error) {
+	if l.Config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	total := uint64(0)
+
+	for _, s := range l.segments {
+		total += s.store.size
+	}
+
+	removals := []Removal{}
+
+	for len(l.segments) > 1 {
+		s := l.segments[0]
+
+		reason, err := l.retentionReason(s, total)
+
+		if err != nil {
+			return removals, err
+		}
+
+		if reason == "" {
+			break
+		}
+
+		l.cache.reset()
+
+		if err := s.Remove(); err != nil {
+			return removals, err
+		}
+
+		removals = append(removals, Removal{BaseOffset: s.baseOffset, NextOffset: s.nextOffset, Bytes: s.store.size, Reason: reason})
+
+		total -= s.store.size
+		l.segments = l.segments[1:]
+	}
+
+	return removals, nil
+}
+
+func (l *Log) retentionReason(s *segment, total uint64) (RetentionReason, error) {
+	retention := l.Config.Retention
+
+	if retention.LowestOffset > 0 && s.nextOffset <= retention.LowestOffset {
+		return RetentionOffset, nil
+	}
+
+	if retention.MaxBytes > 0 && total > retention.MaxBytes {
+		return RetentionBytes, nil
+	}
+
+	if retention.MaxAge > 0 {
+		newest, err := s.newestTime()
+
+		if err != nil {
+			return "", err
+		}
+
+		if time.Since(newest) > retention.MaxAge {
+			return RetentionAge, nil
+		}
+	}
+
+	return "", nil
+}
+
+// newestTime returns the time the newest record in the segment was appended.
+// Segments written before records carried timestamps fall back to the
+// modification time of their store.
+func (s *segment) newestTime() (time.Time, error) {
+	if s.maxTimestamp > 0 {
+		return time.UnixMilli(s.maxTimestamp), nil
+	}
+
+	fi, err := os.Stat(s.store.Name())
+
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return fi.ModTime(), nil
+}
+
+func (l *Log) clean() {
+	removals, err := l.Clean()
+
+	for _, r := range removals {
+		log.Printf("retention removed segment %d (next offset %d, %d bytes): %s", r.BaseOffset, r.NextOffset, r.Bytes, r.Reason)
+	}
+
+	if err != nil {
+		log.Printf("retention: %v", err)
+	}
+}
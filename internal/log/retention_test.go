@@ -0,0 +1,112 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetention(t *testing.T) {
+	scenarios := map[string]func(t *testing.T, c Config){
+		"retain max bytes":      testRetainMaxBytes,
+		"retain max age":        testRetainMaxAge,
+		"retain lowest offset":  testRetainLowestOffset,
+		"clean in background":   testCleanInBackground,
+		"never remove the last": testNeverRemoveActive,
+	}
+	for scenario, fn := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxIndexBytes = entierWidth * 2
+
+			fn(t, c)
+		})
+	}
+}
+
+func newRetentionTestLog(t *testing.T, c Config, records int) *Log {
+	t.Helper()
+
+	log := newTestLog(t, c)
+
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	return log
+}
+
+func testRetainMaxBytes(t *testing.T, c Config) {
+	log := newRetentionTestLog(t, c, 6)
+	require.Len(t, log.segments, 4)
+
+	log.Config.Retention.MaxBytes = log.segments[0].store.size * 2
+	removals, err := log.Clean()
+	require.NoError(t, err)
+	require.Len(t, removals, 2)
+	require.Equal(t, Removal{BaseOffset: 0, NextOffset: 2, Bytes: removals[0].Bytes, Reason: RetentionBytes}, removals[0])
+	require.Equal(t, uint64(2), removals[1].BaseOffset)
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	_, err = log.Read(3)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 3}, err)
+}
+
+func testRetainMaxAge(t *testing.T, c Config) {
+	log := newRetentionTestLog(t, c, 4)
+	time.Sleep(20 * time.Millisecond)
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	log.Config.Retention.MaxAge = 10 * time.Millisecond
+	removals, err := log.Clean()
+	require.NoError(t, err)
+	require.Len(t, removals, 2)
+	require.Equal(t, RetentionAge, removals[0].Reason)
+	require.Len(t, log.segments, 1)
+	require.Equal(t, uint64(4), log.segments[0].baseOffset)
+}
+
+func testRetainLowestOffset(t *testing.T, c Config) {
+	log := newRetentionTestLog(t, c, 6)
+
+	log.Config.Retention.LowestOffset = 3
+	removals, err := log.Clean()
+	require.NoError(t, err)
+	require.Len(t, removals, 1)
+	require.Equal(t, RetentionOffset, removals[0].Reason)
+
+	off, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func testCleanInBackground(t *testing.T, c Config) {
+	c.Retention.LowestOffset = 4
+	c.Retention.Interval = time.Millisecond
+	log := newRetentionTestLog(t, c, 6)
+
+	require.Eventually(t, func() bool {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		return off == 4
+	}, time.Second, time.Millisecond)
+}
+
+func testNeverRemoveActive(t *testing.T, c Config) {
+	log := newRetentionTestLog(t, c, 1)
+
+	log.Config.Retention.MaxBytes = 1
+	log.Config.Retention.LowestOffset = 10
+	removals, err := log.Clean()
+	require.NoError(t, err)
+	require.Empty(t, removals)
+	require.Len(t, log.segments, 1)
+}
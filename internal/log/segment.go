@@ -2,9 +2,13 @@ package log
 
 import (
 	api "distributed-services-in-go/api/v1"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 )
@@ -12,16 +16,28 @@ import (
 type segment struct {
 	store                  *store
 	index                  *index
+	timeIndex              *timeIndex
 	baseOffset, nextOffset uint64
+	maxTimestamp           int64
 	config                 Config
+	repair                 Repair
+
+	// closed is set once the segment is closed, under the log's write lock,
+	// so iterators holding it know to look it up again.
+	closed bool
+}
+
+// segmentMark records the size of a segment so a failed batch can be undone.
+type segmentMark struct {
+	nextOffset       uint64
+	storeSize        uint64
+	indexEntries     uint64
+	timeIndexEntries uint64
+	maxTimestamp     int64
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
-	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
+	storeFile, err := openSegmentFile(dir, baseOffset, ".store", c)
 
 	if err != nil {
 		return nil, err
@@ -33,11 +49,13 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
+	if !c.ReadOnly {
+		if err := setupStoreHeader(store, c); err != nil {
+			return nil, err
+		}
+	}
+
+	indexFile, err := openIndexFile(dir, baseOffset, ".index", c)
 
 	if err != nil {
 		return nil, err
@@ -49,75 +67,386 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	offset, _, err := index.Read(-1)
+	timeIndexFile, err := openIndexFile(dir, baseOffset, ".timeindex", c)
 
-	var nextOffset uint64
 	if err != nil {
-		nextOffset = baseOffset
-	} else {
-		nextOffset = baseOffset + uint64(offset) + 1
+		return nil, err
 	}
 
-	segment := segment{store: store, index: index, baseOffset: baseOffset, nextOffset: nextOffset, config: c}
+	timeIndex, err := newTimeIndex(timeIndexFile, c)
+
+	if err != nil {
+		return nil, err
+	}
+
+	segment := segment{store: store, index: index, timeIndex: timeIndex, baseOffset: baseOffset, config: c}
+
+	if segment.repair, err = segment.recover(); err != nil {
+		return nil, err
+	}
 
 	return &segment, nil
 }
 
+// setupStoreHeader gives a new store a header of the current version and
+// records the features the config may add to the frames of an existing one.
+// Stores of the headerless versions keep their layout until they are
+// upgraded.
+func setupStoreHeader(store *store, c Config) error {
+	if store.size == 0 {
+		return store.writeStoreHeader(storeFlags(c))
+	}
+
+	if store.version < currentStoreVersion {
+		return nil
+	}
+
+	return store.addStoreFlags(storeFlags(c))
+}
+
+// openSegmentFile opens the file of the segment at baseOffset with extension
+// ext, creating it unless the log is read-only.
+func openSegmentFile(dir string, baseOffset uint64, ext string, c Config) (*os.File, error) {
+	name := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+
+	if c.ReadOnly {
+		return os.Open(name)
+	}
+
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// openIndexFile opens an index file of the segment at baseOffset. A read-only
+// log cannot create one that is missing, it gets a nil file instead and the
+// index is rebuilt from the store in memory.
+func openIndexFile(dir string, baseOffset uint64, ext string, c Config) (*os.File, error) {
+	file, err := openSegmentFile(dir, baseOffset, ext, c)
+
+	if c.ReadOnly && errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return file, err
+}
+
 func (s *segment) Append(record *api.Record) (uint64, error) {
-	curOffset := s.nextOffset
-	record.Offset = curOffset
+	return s.AppendBatch([]*api.Record{record})
+}
+
+// AppendBatch writes records at consecutive offsets and returns the first of
+// them. Without a codec every record is stored in a frame of its own, with one
+// the records are compressed together into a single frame.
+func (s *segment) AppendBatch(records []*api.Record) (uint64, error) {
+	first := s.nextOffset
+	encoded := make([][]byte, len(records))
+
+	for i, record := range records {
+		record.Offset = first + uint64(i)
+
+		encodedRecord, err := proto.Marshal(record)
 
-	encodedRecord, err := proto.Marshal(record)
+		if err != nil {
+			return 0, err
+		}
+
+		encoded[i] = encodedRecord
+	}
+
+	codec := s.config.Compression.Codec
+
+	if codec == nil {
+		for i, encodedRecord := range encoded {
+			if err := s.appendFrame(encodedRecord, records[i:i+1]); err != nil {
+				return 0, err
+			}
+		}
+
+		return first, nil
+	}
+
+	payload, err := encodeBatch(codec, encoded)
 
 	if err != nil {
 		return 0, err
 	}
 
-	_, pos, err := s.store.Append(encodedRecord)
+	if err := s.appendFrame(payload, records); err != nil {
+		return 0, err
+	}
+
+	return first, nil
+}
+
+// appendFrame stores payload as the frame holding records and indexes it by
+// the offset of its first record.
+func (s *segment) appendFrame(payload []byte, records []*api.Record) error {
+	if keys := s.config.Encryption.Keys; keys != nil {
+		encrypted, err := encryptFrame(keys, payload)
+
+		if err != nil {
+			return err
+		}
+
+		payload = encrypted
+	}
+
+	_, pos, err := s.store.Append(payload)
 
 	if err != nil {
-		return 0, nil
+		return err
 	}
 
-	if err := s.index.Write(uint32(record.Offset-s.baseOffset), pos); err != nil {
-		return 0, err
+	indexed := s.needsIndexEntry(pos)
+
+	if indexed {
+		if err := s.index.Write(records[0].Offset-s.baseOffset, pos); err != nil {
+			if err := s.store.Truncate(pos); err != nil {
+				return err
+			}
+
+			return err
+		}
 	}
 
-	s.nextOffset++
-	return curOffset, nil
+	if _, err := s.indexTimestamps(records, indexed, s.timeIndex.Write); err != nil {
+		return err
+	}
+
+	s.nextOffset = records[len(records)-1].Offset + 1
+	return nil
 }
 
+// indexTimestamps writes the time index entries for records, stored in a frame
+// that got an index entry when indexed is set. A record gets one when it is
+// newer than every record before it; under a sparse index only the first such
+// record of an indexed frame does, and lookups scan from there like reads.
+func (s *segment) indexTimestamps(records []*api.Record, indexed bool, write func(int64, uint64) error) (uint64, error) {
+	sparse := s.config.Segment.IndexIntervalBytes > 0
+	written := uint64(0)
+
+	for _, record := range records {
+		if record.Timestamp <= s.maxTimestamp {
+			continue
+		}
+
+		if !sparse || (indexed && written == 0) {
+			if err := write(record.Timestamp, record.Offset-s.baseOffset); err != nil {
+				return written, err
+			}
+
+			written++
+		}
+
+		s.maxTimestamp = record.Timestamp
+	}
+
+	return written, nil
+}
+
+// OffsetForTime returns the first offset in the segment appended at or after
+// timestamp, or io.EOF when every record is older. Under a sparse index the
+// records newer than the last older entry are scanned for it.
+func (s *segment) OffsetForTime(timestamp int64) (uint64, error) {
+	if s.config.Segment.IndexIntervalBytes == 0 {
+		offset, err := s.timeIndex.Lookup(timestamp)
+
+		if err != nil {
+			return 0, err
+		}
+
+		return s.baseOffset + offset, nil
+	}
+
+	pos := s.store.start
+
+	if from, err := s.timeIndex.Before(timestamp); err == nil {
+		if _, floor, err := s.index.Floor(from); err == nil {
+			pos = floor
+		}
+	}
+
+	for pos < s.store.size {
+		records, size, err := s.readFrame(pos)
+
+		if err != nil {
+			return 0, err
+		}
+
+		for _, record := range records {
+			if record.Timestamp >= timestamp {
+				return record.Offset, nil
+			}
+		}
+
+		pos += size
+	}
+
+	return 0, io.EOF
+}
+
+// Read returns the record at offset. The store is scanned forward from the
+// nearest index entry, which is the record itself unless the index is sparse
+// or compaction removed the record.
 func (s *segment) Read(offset uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(offset - s.baseOffset))
+	_, pos, err := s.index.Floor(offset - s.baseOffset)
+
+	if err == io.EOF {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	encodedValue, err := s.store.Read(pos)
+	for pos < s.store.size {
+		records, size, err := s.readFrame(pos)
+
+		if errors.Is(err, errCorruptFrame) {
+			return nil, api.ErrCorruptRecord{Offset: offset}
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range records {
+			if record.Offset == offset {
+				return record, nil
+			}
+		}
+
+		if records[0].Offset > offset {
+			break
+		}
+
+		pos += size
+	}
+
+	return nil, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
+// needsIndexEntry reports whether the record stored at pos gets an index entry.
+// Every record does unless Config.Segment.IndexIntervalBytes is set.
+func (s *segment) needsIndexEntry(pos uint64) bool {
+	_, last, err := s.index.Read(-1)
+
+	if err != nil || s.config.Segment.IndexIntervalBytes == 0 {
+		return true
+	}
+
+	return pos-last >= s.config.Segment.IndexIntervalBytes
+}
+
+// readFrame decodes the records stored in the frame at pos and returns them
+// with the size of the frame. A frame that does not hold valid records returns
+// errCorruptFrame.
+func (s *segment) readFrame(pos uint64) ([]*api.Record, uint64, error) {
+	payload, err := s.store.Read(pos)
 
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	record := &api.Record{}
+	size := s.store.frameHeaderWidth() + uint64(len(payload))
 
-	if err := proto.Unmarshal(encodedValue, record); err != nil {
-		return nil, err
+	if isEncrypted(payload) {
+		if payload, err = decryptFrame(s.config.Encryption.Keys, payload); err != nil {
+			return nil, 0, err
+		}
 	}
 
-	return record, nil
+	encoded := [][]byte{payload}
+
+	if len(payload) > 0 && payload[0] == batchMarker {
+		if encoded, err = decodeBatch(s.config, payload); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if len(encoded) == 0 {
+		return nil, 0, errCorruptFrame
+	}
+
+	records := make([]*api.Record, len(encoded))
+
+	for i, encodedRecord := range encoded {
+		records[i] = &api.Record{}
+
+		if err := proto.Unmarshal(encodedRecord, records[i]); err != nil {
+			return nil, 0, errCorruptFrame
+		}
+	}
+
+	return records, size, nil
+}
+
+func (s *segment) mark() segmentMark {
+	return segmentMark{
+		nextOffset:       s.nextOffset,
+		storeSize:        s.store.size,
+		indexEntries:     s.index.Entries(),
+		timeIndexEntries: s.timeIndex.Entries(),
+		maxTimestamp:     s.maxTimestamp,
+	}
+}
+
+func (s *segment) rollback(m segmentMark) error {
+	s.index.Truncate(m.indexEntries)
+	s.timeIndex.Truncate(m.timeIndexEntries)
+	s.nextOffset = m.nextOffset
+	s.maxTimestamp = m.maxTimestamp
+
+	return s.store.Truncate(m.storeSize)
+}
+
+// IsExpired reports whether the first record of the segment was appended more
+// than maxAge ago. Segments without timestamped records never expire.
+func (s *segment) IsExpired(maxAge time.Duration) bool {
+	timestamp, _, err := s.timeIndex.Read(0)
+
+	if maxAge == 0 || err != nil {
+		return false
+	}
+
+	return time.Since(time.UnixMilli(timestamp)) >= maxAge
 }
 
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes || s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.size-s.store.start >= s.config.Segment.MaxStoreBytes || s.Remaining() == 0
+}
+
+// Remaining returns how many more records are sure to fit into the segment.
+// Each record may take an entry in the time index, and under a sparse index
+// the time index fills up before the offset index does.
+func (s *segment) Remaining() uint64 {
+	return min(s.index.Remaining(), s.timeIndex.Remaining())
+}
+
+// Sync fsyncs the files of the segment. It only touches the store under its
+// own lock and the index files, so it is safe alongside appends and reads.
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+
+	return s.timeIndex.Sync()
 }
 
 func (s *segment) Close() error {
+	s.closed = true
+
 	if err := s.index.Close(); err != nil {
 		return err
 	}
 
+	if err := s.timeIndex.Close(); err != nil {
+		return err
+	}
+
 	if err := s.store.Close(); err != nil {
 		return err
 	}
@@ -135,6 +464,10 @@ func (s *segment) Remove() error {
 		return err
 	}
 
+	if err := os.Remove(s.timeIndex.Name()); err != nil {
+		return err
+	}
+
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
@@ -0,0 +1,36 @@
+package log
+
+import "sync/atomic"
+
+const segmentCacheSize = 4
+
+// segmentCache remembers the segments most recently used by Log.Read, so
+// consumers tailing the log or re-reading a hot range skip the segment search.
+// It is safe for concurrent readers holding l.mu for reading and must be reset
+// under the write lock whenever segments are removed or replaced.
+type segmentCache struct {
+	entries [segmentCacheSize]atomic.Pointer[segment]
+	next    atomic.Uint32
+}
+
+func (c *segmentCache) get(off uint64) *segment {
+	for i := range c.entries {
+		s := c.entries[i].Load()
+
+		if s != nil && s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (c *segmentCache) put(s *segment) {
+	c.entries[c.next.Add(1)%segmentCacheSize].Store(s)
+}
+
+func (c *segmentCache) reset() {
+	for i := range c.entries {
+		c.entries[i].Store(nil)
+	}
+}
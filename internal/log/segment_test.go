@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -70,3 +71,349 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, err)
 	require.False(t, s.IsMaxed())
 }
+
+func TestSegmentRecover(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-recover-test")
+
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("Hello World!")}
+
+	c := Config{}
+
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(want)
+		require.NoError(t, err)
+	}
+
+	// Simulate a crash: the store and index reach the disk but the index file is
+	// never truncated back to its real size, and the last frame is torn.
+	require.NoError(t, s.store.buf.Flush())
+	require.NoError(t, s.index.mmap.Flush())
+
+	storeSize := s.store.size
+
+	_, err = s.store.File.Write([]byte{0, 0, 0, 0, 0, 0, 0, 100, 1, 2, 3})
+
+	require.NoError(t, err)
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, storeSize, s.store.size)
+	require.Equal(t, c.Segment.MaxIndexBytes/entierWidth-3, s.repair.DroppedIndexEntries)
+	require.Equal(t, uint64(11), s.repair.TruncatedStoreBytes)
+
+	for i := uint64(16); i < 19; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// A dangling index entry pointing past the end of the store is dropped and
+	// the record it described is appended again at the same offset.
+	require.NoError(t, s.index.Write(3, storeSize))
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, uint64(1), s.repair.DroppedIndexEntries)
+
+	off, err := s.Append(want)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), off)
+
+	// Complete frames that never made it into the index are indexed again
+	require.NoError(t, s.store.buf.Flush())
+
+	s.index.Truncate(2)
+
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(20), s.nextOffset)
+	require.Equal(t, uint64(2), s.repair.RecoveredRecords)
+
+	// A corrupt first frame fails the segment instead of emptying the store.
+	require.NoError(t, s.Close())
+	require.NoError(t, os.Remove(s.index.Name()))
+
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+
+	b := make([]byte, 1)
+	_, err = f.ReadAt(b, int64(s.store.start+headerWidth))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{b[0] ^ 0xff}, int64(s.store.start+headerWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = newSegment(dir, 16, c)
+	require.ErrorIs(t, err, errCorruptFrame)
+
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, s.store.size, uint64(fi.Size()))
+}
+
+func TestSegmentRebuildIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-rebuild-test")
+
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("Hello World!")}
+
+	c := Config{}
+
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(want)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Close())
+
+	// Missing index
+	require.NoError(t, os.Remove(s.index.Name()))
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, uint64(3), s.repair.RecoveredRecords)
+
+	// Damaged entry in the middle of the index
+	_, pos, err := s.index.Read(2)
+
+	require.NoError(t, err)
+
+	s.index.Truncate(1)
+
+	require.NoError(t, s.index.Write(7, pos))
+	require.NoError(t, s.index.Write(2, pos))
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(19), s.nextOffset)
+	require.Equal(t, uint64(2), s.repair.DroppedIndexEntries)
+	require.Equal(t, uint64(2), s.repair.RecoveredRecords)
+
+	for i := uint64(16); i < 19; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+		require.Equal(t, i, got.Offset)
+	}
+
+	// Last entry pointing inside its frame, still in order
+	_, pos, err = s.index.Read(2)
+
+	require.NoError(t, err)
+
+	s.index.Truncate(2)
+
+	require.NoError(t, s.index.Write(2, pos+1))
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(1), s.repair.DroppedIndexEntries)
+	require.Equal(t, uint64(1), s.repair.RecoveredRecords)
+	require.Zero(t, s.repair.TruncatedStoreBytes)
+
+	for i := uint64(16); i < 19; i++ {
+		got, err := s.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got.Offset)
+	}
+
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentRollback(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-rollback-test")
+
+	require.NoError(t, err)
+
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("Hello World!")}
+
+	c := Config{}
+
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+
+	_, err = s.Append(want)
+
+	require.NoError(t, err)
+
+	mark := s.mark()
+
+	for i := 0; i < 2; i++ {
+		_, err := s.Append(want)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.rollback(mark))
+
+	require.Equal(t, mark, s.mark())
+
+	_, err = s.Read(17)
+
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 17}, err)
+
+	off, err := s.Append(want)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(17), off)
+
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+
+	require.NoError(t, err)
+	require.True(t, s.repair.IsEmpty())
+	require.Equal(t, uint64(18), s.nextOffset)
+
+	require.NoError(t, s.Remove())
+}
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "segment-sparse-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalBytes = 64
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+
+	const records = 20
+
+	for i := 0; i < records; i++ {
+		_, err := s.Append(&api.Record{Value: []byte("Hello World!")})
+		require.NoError(t, err)
+	}
+
+	// Each frame is well below the interval, so only some records are indexed.
+	require.Less(t, s.index.Entries(), uint64(records/2))
+
+	testReads := func(s *segment) {
+		t.Helper()
+
+		for off := uint64(16); off < 16+records; off++ {
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, got.Offset)
+		}
+
+		_, err := s.Read(16 + records)
+		require.Equal(t, api.ErrOffsetOutOfRange{Offset: 16 + records}, err)
+	}
+
+	testReads(s)
+
+	entries := s.index.Entries()
+	require.NoError(t, s.Close())
+
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.True(t, s.repair.IsEmpty())
+	require.Equal(t, entries, s.index.Entries())
+	require.Equal(t, uint64(16+records), s.nextOffset)
+	testReads(s)
+
+	// Records appended a few milliseconds apart all carry new timestamps.
+	// Under a sparse index they still only get an entry in either index
+	// every IndexIntervalBytes, so a segment fits far more of them.
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.IndexIntervalBytes = 1024
+
+	log := newTestLog(t, c)
+
+	const appended = 100
+
+	for i := 0; i < appended; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("Hello World!")})
+		require.NoError(t, err, "append %d", i)
+
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	require.Len(t, log.segments, 1)
+
+	// Dense indexes would take an entry in each for every record.
+	indexBytes := log.activeSegment.index.size + log.activeSegment.timeIndex.size
+	require.Less(t, indexBytes*8, uint64(appended)*(entierWidth+timeEntryWidth))
+
+	timeEntries := log.activeSegment.timeIndex.Entries()
+	require.Equal(t, log.activeSegment.index.Entries(), timeEntries)
+
+	requireLookups := func(log *Log) {
+		t.Helper()
+
+		for off := uint64(0); off < appended; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+
+			got, err := log.OffsetForTime(time.UnixMilli(record.Timestamp))
+			require.NoError(t, err)
+			require.Equal(t, off, got)
+		}
+	}
+
+	requireLookups(log)
+
+	// A rebuilt time index is just as sparse.
+	require.NoError(t, log.Close())
+	require.NoError(t, os.Remove(log.activeSegment.timeIndex.Name()))
+
+	log, err = NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Equal(t, timeEntries, log.Repairs[0].RecoveredTimeIndexEntries)
+	requireLookups(log)
+}
@@ -0,0 +1,591 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// snapshotMagic starts every snapshot stream, followed by its version.
+	snapshotMagic = "LSNP"
+
+	// Version 2 keeps the records of an encrypted log encrypted.
+	snapshotVersion uint32 = 2
+
+	snapshotHeaderWidth = len(snapshotMagic) + 4
+
+	// restoreDir holds the segments being built by Restore. Leftovers of an
+	// interrupted restore are removed when the log is opened.
+	restoreDir = ".restore"
+
+	// restoredDir is restoreDir once the segments in it are built and synced.
+	// Renaming it commits a restore: opening the log finishes the swap of a
+	// committed one.
+	restoredDir = ".restored"
+
+	// restoreManifest lists the base offsets of the restored segments, so a
+	// swap that is finished again after a crash knows which files are new.
+	restoreManifest = "segments.json"
+)
+
+// Snapshot streams are the magic and version followed by frames framed like
+// store frames, a length and a CRC32-C of the payload. The first byte of the
+// payload is the kind of the frame: one header, the records in offset order,
+// and a trailer counting them so a cut off stream is caught.
+const (
+	snapshotHeaderFrame byte = iota
+	snapshotRecordFrame
+	snapshotTrailerFrame
+)
+
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+// snapshotHeader describes the log a snapshot was taken of.
+type snapshotHeader struct {
+	CreatedAt    time.Time `json:"created_at"`
+	Metadata     Metadata  `json:"metadata"`
+	LowestOffset uint64    `json:"lowest_offset"`
+	NextOffset   uint64    `json:"next_offset"`
+	Encrypted    bool      `json:"encrypted,omitempty"`
+}
+
+// Snapshot writes the records of the log, as they are when it is called, to
+// w. Records appended while it runs are left out, and retention, compaction
+// and Truncate wait for it to finish. Records are written decompressed; with
+// encryption keys configured they stay encrypted, under the current key, so
+// only a log with the same keys can restore them. Restore stores them again
+// under the config of its log.
+func (l *Log) Snapshot(w io.Writer) error {
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
+	l.mu.RLock()
+
+	segments := slices.Clone(l.segments)
+	sizes := make([]uint64, len(segments))
+
+	for i, s := range segments {
+		sizes[i] = s.store.size
+	}
+
+	header := snapshotHeader{
+		CreatedAt:    time.Now().UTC(),
+		Metadata:     l.Metadata,
+		LowestOffset: segments[0].baseOffset,
+		NextOffset:   l.activeSegment.nextOffset,
+		Encrypted:    l.Config.Encryption.Keys != nil,
+	}
+
+	l.mu.RUnlock()
+
+	magic := make([]byte, snapshotHeaderWidth)
+	copy(magic, snapshotMagic)
+	enc.PutUint32(magic[len(snapshotMagic):], snapshotVersion)
+
+	if _, err := w.Write(magic); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(header)
+
+	if err != nil {
+		return err
+	}
+
+	if err := writeSnapshotFrame(w, snapshotHeaderFrame, data); err != nil {
+		return err
+	}
+
+	count := uint64(0)
+
+	for i, s := range segments {
+		for pos := s.store.start; pos < sizes[i]; {
+			l.mu.RLock()
+			records, size, err := s.readFrame(pos)
+			l.mu.RUnlock()
+
+			if err != nil {
+				return fmt.Errorf("snapshot segment %d: %w", s.baseOffset, err)
+			}
+
+			pos += size
+
+			for _, record := range records {
+				if record.Offset >= header.NextOffset {
+					continue
+				}
+
+				data, err := proto.Marshal(record)
+
+				if err != nil {
+					return err
+				}
+
+				if header.Encrypted {
+					if data, err = encryptFrame(l.Config.Encryption.Keys, data); err != nil {
+						return err
+					}
+				}
+
+				if err := writeSnapshotFrame(w, snapshotRecordFrame, data); err != nil {
+					return err
+				}
+
+				count++
+			}
+		}
+	}
+
+	trailer := make([]byte, lenWidth)
+	enc.PutUint64(trailer, count)
+
+	return writeSnapshotFrame(w, snapshotTrailerFrame, trailer)
+}
+
+// Restore replaces the records of the log with those of a snapshot read from
+// r. Records keep their offsets and timestamps and are stored under the config
+// of the log. The whole snapshot is read and checked, and the new segments are
+// built and synced, before the log is touched: a corrupt or cut off snapshot
+// leaves it as it was. Once the new segments are in place a crash does not
+// lose them either, opening the log finishes the swap.
+func (l *Log) Restore(r io.Reader) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
+	baseOffsets, err := l.buildRestore(r)
+
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.Config.Sync.Policy != SyncNever {
+		if err := l.sync(); err != nil {
+			os.RemoveAll(path.Join(l.Dir, restoreDir))
+			return err
+		}
+	}
+
+	// Up to here the old segments are untouched, from here on the restore
+	// is committed.
+	if err := os.Rename(path.Join(l.Dir, restoreDir), path.Join(l.Dir, restoredDir)); err != nil {
+		os.RemoveAll(path.Join(l.Dir, restoreDir))
+		return err
+	}
+
+	// The active segment is replaced, waiters check again whatever happens.
+	defer l.notifyAppended()
+
+	segments, active := l.segments, l.activeSegment
+
+	if err := l.swapRestored(baseOffsets); err != nil {
+		return l.reopenRestored(segments, active, err)
+	}
+
+	return nil
+}
+
+// swapRestored closes the segments of the log and opens those of the committed
+// restore in their place.
+func (l *Log) swapRestored(baseOffsets []uint64) error {
+	if err := syncDir(l.Dir); err != nil {
+		return err
+	}
+
+	var closeErr error
+
+	for _, s := range l.segments {
+		if err := s.Close(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+
+	l.segments = nil
+	l.activeSegment = nil
+	l.lastTimestamp = 0
+	l.cache.reset()
+
+	if closeErr != nil {
+		return closeErr
+	}
+
+	if err := finishRestore(l.Dir); err != nil {
+		return err
+	}
+
+	for _, baseOffset := range baseOffsets {
+		if err := l.newSegment(baseOffset); err != nil {
+			return err
+		}
+	}
+
+	for i := 1; i < len(l.segments); i++ {
+		l.segments[i-1].nextOffset = l.segments[i].baseOffset
+		mapClosed(l.segments[i-1])
+	}
+
+	return nil
+}
+
+// reopenRestored handles a failure to swap in a committed restore by opening
+// the log again from the directory, which finishes the restore the same way
+// NewLog would. When that fails too, the closed segments are put back so the
+// log behaves as closed and has to be opened again.
+func (l *Log) reopenRestored(segments []*segment, active *segment, failure error) error {
+	reopen := func() error {
+		for _, s := range l.segments {
+			s.Close()
+		}
+
+		l.segments = nil
+		l.activeSegment = nil
+		l.lastTimestamp = 0
+		l.cache.reset()
+
+		return l.open()
+	}
+
+	if err := reopen(); err != nil {
+		for _, s := range l.segments {
+			s.Close()
+		}
+
+		l.segments = segments
+		l.activeSegment = active
+		l.cache.reset()
+
+		return fmt.Errorf("restore committed but the log could not be reopened: %w: %w", failure, err)
+	}
+
+	return nil
+}
+
+// buildRestore writes the segments of the snapshot read from r into
+// restoreDir, along with the manifest listing them, and syncs them. It returns
+// their base offsets. Nothing is left behind when it fails.
+func (l *Log) buildRestore(r io.Reader) ([]uint64, error) {
+	dir := path.Join(l.Dir, restoreDir)
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	baseOffsets, err := l.readSnapshot(r, dir)
+
+	if err == nil {
+		err = writeRestoreManifest(dir, baseOffsets)
+	}
+
+	if err == nil {
+		err = syncDir(dir)
+	}
+
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	return baseOffsets, nil
+}
+
+func writeRestoreManifest(dir string, baseOffsets []uint64) error {
+	data, err := json.Marshal(baseOffsets)
+
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path.Join(dir, restoreManifest))
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// finishRestore swaps the segments of a committed restore into dir, if there
+// is one. The restored files are renamed over those of the same name, every
+// other segment file is removed and restoredDir goes last, so every step can
+// run again when a crash interrupts it.
+func finishRestore(dir string) error {
+	restored := path.Join(dir, restoredDir)
+	data, err := os.ReadFile(path.Join(restored, restoreManifest))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	baseOffsets := []uint64{}
+
+	if err := json.Unmarshal(data, &baseOffsets); err != nil {
+		return fmt.Errorf("%s: %w", restored, err)
+	}
+
+	keep := map[string]bool{}
+
+	for _, baseOffset := range baseOffsets {
+		for _, ext := range []string{".store", ".index", ".timeindex"} {
+			name := fmt.Sprintf("%d%s", baseOffset, ext)
+			keep[name] = true
+
+			// A file missing here was moved before a crash.
+			err := os.Rename(path.Join(restored, name), path.Join(dir, name))
+
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if !segmentFileName.MatchString(file.Name()) || keep[file.Name()] {
+			continue
+		}
+
+		if err := os.Remove(path.Join(dir, file.Name())); err != nil {
+			return err
+		}
+	}
+
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+
+	return os.RemoveAll(restored)
+}
+
+// readSnapshot checks the snapshot read from r and writes its records into
+// segments in dir, rolling them as the config of the log requires. It returns
+// the base offsets of the segments.
+func (l *Log) readSnapshot(r io.Reader, dir string) ([]uint64, error) {
+	magic := make([]byte, snapshotHeaderWidth)
+
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("%w: %w", errCorruptSnapshot, err)
+	}
+
+	if string(magic[:len(snapshotMagic)]) != snapshotMagic {
+		return nil, fmt.Errorf("%w: not a snapshot", errCorruptSnapshot)
+	}
+
+	if version := enc.Uint32(magic[len(snapshotMagic):]); version > snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	kind, data, err := readSnapshotFrame(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if kind != snapshotHeaderFrame {
+		return nil, fmt.Errorf("%w: missing header", errCorruptSnapshot)
+	}
+
+	header := snapshotHeader{}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, fmt.Errorf("%w: %w", errCorruptSnapshot, err)
+	}
+
+	keys := l.Config.Encryption.Keys
+
+	if header.Encrypted && keys == nil {
+		return nil, errNoKeyProvider
+	}
+
+	var s *segment
+	segments := []*segment{}
+
+	closeAll := func() {
+		for _, s := range segments {
+			s.Close()
+		}
+	}
+
+	next := header.LowestOffset
+	count := uint64(0)
+
+	for {
+		kind, data, err := readSnapshotFrame(r)
+
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		if kind == snapshotTrailerFrame {
+			if len(data) != lenWidth || enc.Uint64(data) != count {
+				closeAll()
+				return nil, fmt.Errorf("%w: record count does not match", errCorruptSnapshot)
+			}
+
+			break
+		}
+
+		if kind == snapshotRecordFrame && header.Encrypted {
+			if data, err = decryptFrame(keys, data); err != nil {
+				closeAll()
+
+				if errors.Is(err, errCorruptFrame) {
+					return nil, fmt.Errorf("%w: %w", errCorruptSnapshot, err)
+				}
+
+				return nil, err
+			}
+		}
+
+		record := &api.Record{}
+
+		if kind != snapshotRecordFrame || proto.Unmarshal(data, record) != nil {
+			closeAll()
+			return nil, fmt.Errorf("%w: bad record frame", errCorruptSnapshot)
+		}
+
+		if record.Offset < next || record.Offset >= header.NextOffset {
+			closeAll()
+			return nil, fmt.Errorf("%w: record %d out of order", errCorruptSnapshot, record.Offset)
+		}
+
+		isFull := s != nil && s.IsMaxed()
+
+		if s == nil || isFull {
+			base := record.Offset
+
+			if s == nil {
+				base = header.LowestOffset
+			}
+
+			if s, err = newSegment(dir, base, l.Config); err != nil {
+				closeAll()
+				return nil, err
+			}
+
+			segments = append(segments, s)
+		}
+
+		s.nextOffset = record.Offset
+
+		if _, err := s.Append(record); err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		next = record.Offset + 1
+		count++
+	}
+
+	// The newest records may be gone, the log still continues at NextOffset.
+	if s == nil || s.nextOffset < header.NextOffset {
+		if s, err = newSegment(dir, header.NextOffset, l.Config); err != nil {
+			closeAll()
+			return nil, err
+		}
+
+		segments = append(segments, s)
+	}
+
+	baseOffsets := make([]uint64, len(segments))
+
+	for i, s := range segments {
+		baseOffsets[i] = s.baseOffset
+
+		if err := s.Sync(); err != nil {
+			closeAll()
+			return nil, err
+		}
+	}
+
+	closeAll()
+
+	return baseOffsets, nil
+}
+
+func writeSnapshotFrame(w io.Writer, kind byte, data []byte) error {
+	payload := append([]byte{kind}, data...)
+
+	header := make([]byte, headerWidth)
+	enc.PutUint64(header[:lenWidth], uint64(len(payload)))
+	enc.PutUint32(header[lenWidth:], crc32.Checksum(payload, crcTable))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload)
+
+	return err
+}
+
+// readSnapshotFrame returns the kind and the data of the next frame of a
+// snapshot. A frame that is cut off or fails its checksum returns
+// errCorruptSnapshot.
+func readSnapshotFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, headerWidth)
+
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", errCorruptSnapshot, err)
+	}
+
+	size := enc.Uint64(header[:lenWidth])
+
+	// The length is not covered by the checksum, so the payload is read
+	// without trusting it up front.
+	buf := bytes.Buffer{}
+
+	if _, err := io.CopyN(&buf, r, int64(size)); err != nil || size == 0 {
+		return 0, nil, fmt.Errorf("%w: cut off frame", errCorruptSnapshot)
+	}
+
+	payload := buf.Bytes()
+
+	if crc32.Checksum(payload, crcTable) != enc.Uint32(header[lenWidth:]) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", errCorruptSnapshot)
+	}
+
+	return payload[0], payload[1:], nil
+}
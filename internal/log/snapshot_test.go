@@ -0,0 +1,279 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+	c.Compression.Codec = GzipCodec{}
+	c.Compaction.TombstoneRetention = time.Hour
+
+	src := newTestLog(t, c)
+
+	records := []*api.Record{
+		{Key: []byte("k1"), Value: []byte("v1")},
+		{Key: []byte("k1"), Value: []byte("v2")},
+		{Key: []byte("k2"), Value: []byte("v1")},
+		{Key: []byte("k2"), Value: []byte("v2")},
+		{Value: []byte("no key")},
+		{Key: []byte("k3"), Value: []byte("v1")},
+	}
+
+	for _, record := range records {
+		_, err := src.Append(record)
+		require.NoError(t, err)
+	}
+
+	// Compaction leaves gaps at 0 and 2.
+	_, err := src.Compact()
+	require.NoError(t, err)
+
+	b := bytes.Buffer{}
+	require.NoError(t, src.Snapshot(&b))
+
+	// Records appended after the snapshot are not part of it.
+	_, err = src.Append(&api.Record{Value: []byte("later")})
+	require.NoError(t, err)
+
+	snapshot := b.Bytes()
+
+	// The restored log rolls its segments under its own config.
+	dstConfig := Config{}
+	dstConfig.Segment.MaxIndexBytes = entierWidth * 3
+
+	dst := newTestLog(t, dstConfig)
+
+	_, err = dst.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+
+	// A corrupt or cut off snapshot leaves the log alone.
+	corrupt := bytes.Clone(snapshot)
+	corrupt[len(corrupt)/2] ^= 0xff
+
+	for _, bad := range [][]byte{corrupt, snapshot[:len(snapshot)-1], []byte("not a snapshot")} {
+		require.ErrorIs(t, dst.Restore(bytes.NewReader(bad)), errCorruptSnapshot)
+
+		read, err := dst.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte("replaced"), read.Value)
+	}
+
+	require.NoError(t, dst.Restore(bytes.NewReader(snapshot)))
+
+	requireRestored := func(log *Log, want uint64) {
+		t.Helper()
+
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), lowest)
+
+		highest, err := log.HighestOffset()
+		require.NoError(t, err)
+		require.Equal(t, want, highest)
+
+		for _, off := range []uint64{0, 2} {
+			_, err := log.Read(off)
+			require.Equal(t, api.ErrOffsetOutOfRange{Offset: off}, err)
+		}
+
+		for _, off := range []uint64{1, 3, 4, 5} {
+			want, err := src.Read(off)
+			require.NoError(t, err)
+
+			got, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, got.Value)
+			require.Equal(t, want.Timestamp, got.Timestamp)
+		}
+	}
+
+	requireRestored(dst, 5)
+	require.Len(t, dst.segments, 2)
+
+	off, err := dst.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), off)
+
+	require.NoError(t, dst.Close())
+
+	dst, err = NewLog(dst.Dir, dstConfig)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	requireRestored(dst, 6)
+}
+
+func TestRestoreCrash(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+
+	src := newTestLog(t, c)
+
+	for i := 0; i < 5; i++ {
+		_, err := src.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+
+	b := bytes.Buffer{}
+	require.NoError(t, src.Snapshot(&b))
+
+	dst := newTestLog(t, c)
+
+	for i := 0; i < 3; i++ {
+		_, err := dst.Append(&api.Record{Value: []byte("replaced")})
+		require.NoError(t, err)
+	}
+
+	reopen := func() {
+		t.Helper()
+
+		require.NoError(t, dst.Close())
+
+		var err error
+		dst, err = NewLog(dst.Dir, c)
+		require.NoError(t, err)
+		t.Cleanup(func() { dst.Close() })
+	}
+
+	// A restore that was not committed when the log went down is dropped.
+	_, err := dst.buildRestore(bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+
+	reopen()
+	require.NoDirExists(t, path.Join(dst.Dir, restoreDir))
+
+	for off := uint64(0); off < 3; off++ {
+		read, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("replaced"), read.Value)
+	}
+
+	// A committed one is finished, even when the swap was cut off after the
+	// first store replaced the old one.
+	_, err = dst.buildRestore(bytes.NewReader(b.Bytes()))
+	require.NoError(t, err)
+
+	restored := path.Join(dst.Dir, restoredDir)
+	require.NoError(t, os.Rename(path.Join(dst.Dir, restoreDir), restored))
+	require.NoError(t, os.Rename(path.Join(restored, "0.store"), path.Join(dst.Dir, "0.store")))
+
+	reopen()
+	require.NoDirExists(t, path.Join(dst.Dir, restoredDir))
+	require.Empty(t, dst.Repairs)
+	require.Len(t, dst.segments, 3)
+
+	for off := uint64(0); off < 5; off++ {
+		read, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprint(off)), read.Value)
+	}
+}
+
+func TestRestoreReopen(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entierWidth * 2
+
+	src := newTestLog(t, c)
+
+	for i := 0; i < 5; i++ {
+		_, err := src.Append(&api.Record{Value: []byte(fmt.Sprint(i))})
+		require.NoError(t, err)
+	}
+
+	b := bytes.Buffer{}
+	require.NoError(t, src.Snapshot(&b))
+
+	// commit builds a restore and commits it, then fails the swap after the
+	// old segments were closed. A non-nil manifest replaces the restore's.
+	commit := func(l *Log, manifest []byte) error {
+		t.Helper()
+
+		_, err := l.buildRestore(bytes.NewReader(b.Bytes()))
+		require.NoError(t, err)
+
+		if manifest != nil {
+			require.NoError(t, os.WriteFile(path.Join(l.Dir, restoreDir, restoreManifest), manifest, 0644))
+		}
+
+		require.NoError(t, os.Rename(path.Join(l.Dir, restoreDir), path.Join(l.Dir, restoredDir)))
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		segments, active := l.segments, l.activeSegment
+
+		for _, s := range segments {
+			require.NoError(t, s.Close())
+		}
+
+		l.segments, l.activeSegment = nil, nil
+
+		return l.reopenRestored(segments, active, errCorruptFrame)
+	}
+
+	// The log is reopened with the restored segments.
+	dst := newTestLog(t, c)
+
+	require.NoError(t, commit(dst, nil))
+	require.NoDirExists(t, path.Join(dst.Dir, restoredDir))
+	require.Len(t, dst.segments, 3)
+
+	for off := uint64(0); off < 5; off++ {
+		read, err := dst.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprint(off)), read.Value)
+	}
+
+	off, err := dst.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	// When it cannot be reopened either, it is left closed.
+	broken := newTestLog(t, c)
+
+	require.ErrorIs(t, commit(broken, []byte("{")), errCorruptFrame)
+	require.Equal(t, os.ErrClosed, broken.Wait(context.Background(), 0))
+
+	_, err = broken.Append(&api.Record{Value: []byte("next")})
+	require.Error(t, err)
+}
+
+func TestSnapshotEncrypted(t *testing.T) {
+	c := Config{}
+	c.Encryption.Keys = StaticKeys{Keys: map[uint32][]byte{0: make([]byte, 32)}}
+
+	src := newTestLog(t, c)
+
+	_, err := src.Append(&api.Record{Value: []byte("secret")})
+	require.NoError(t, err)
+
+	b := bytes.Buffer{}
+	require.NoError(t, src.Snapshot(&b))
+
+	// The records stay encrypted in the stream.
+	require.NotContains(t, b.String(), "secret")
+
+	// A log without the keys cannot restore them and is left alone.
+	plain := newTestLog(t, Config{})
+	require.ErrorIs(t, plain.Restore(bytes.NewReader(b.Bytes())), errNoKeyProvider)
+	require.NoDirExists(t, path.Join(plain.Dir, restoreDir))
+
+	dst := newTestLog(t, c)
+	require.NoError(t, dst.Restore(bytes.NewReader(b.Bytes())))
+
+	read, err := dst.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("secret"), read.Value)
+}
@@ -2,24 +2,54 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
+
+	"github.com/edsrzf/mmap-go"
 )
 
 var (
 	enc = binary.BigEndian
+
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errCorruptFrame = errors.New("corrupt store frame")
 )
 
 const (
-	lenWidth = 8 // 64 bits is 8 bytes
+	lenWidth    = 8 // 64 bits is 8 bytes
+	crcWidth    = 4 // crc32 of the record bytes
+	headerWidth = lenWidth + crcWidth
 )
 
+// store appends frames through a buffered writer guarded by mu. flushed is the
+// number of bytes known to be in the file; reads below it go straight to the
+// file without taking mu, only reads reaching into the buffered tail have to
+// flush it first.
+//
+// Once a store stops changing it can be mapped read-only; reads are then served
+// from the mapping, guarded by mapMu so Truncate and Close can release it.
 type store struct {
-	mu   sync.Mutex
-	File *os.File
-	buf  *bufio.Writer
-	size uint64
+	mu      sync.Mutex
+	File    *os.File
+	buf     *bufio.Writer
+	size    uint64
+	flushed atomic.Uint64
+
+	// version and flags come from the store header, start is where the
+	// first frame begins.
+	version uint32
+	flags   uint64
+	start   uint64
+
+	mapMu  sync.RWMutex
+	mapped mmap.MMap
 }
 
 func newStore(file *os.File) (*store, error) {
@@ -31,16 +61,29 @@ func newStore(file *os.File) (*store, error) {
 
 	size := uint64(fi.Size())
 
-	return &store{File: file, buf: bufio.NewWriter(file), size: size}, nil
+	s := &store{File: file, buf: bufio.NewWriter(file), size: size}
+	s.flushed.Store(size)
+
+	if err := s.readStoreHeader(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 func (s *store) Append(value []byte) (written uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	size_of_data := uint64(len(value))
+	header := make([]byte, s.frameHeaderWidth())
 
-	if err := binary.Write(s.buf, enc, size_of_data); err != nil {
+	enc.PutUint64(header[:lenWidth], uint64(len(value)))
+
+	if s.version != baselineStoreVersion {
+		enc.PutUint32(header[lenWidth:], crc32.Checksum(value, crcTable))
+	}
+
+	if _, err := s.buf.Write(header); err != nil {
 		return 0, 0, err
 	}
 
@@ -50,48 +93,300 @@ func (s *store) Append(value []byte) (written uint64, pos uint64, err error) {
 		return 0, 0, err
 	}
 
-	total_written_size := +uint64(written_size) + lenWidth
+	total_written_size := uint64(written_size) + uint64(len(header))
 	pos = s.size
 	s.size += total_written_size
 
 	return total_written_size, pos, nil
 }
 
+// Read returns the record stored at pos. A frame whose length runs past the
+// end of the store or whose checksum does not match returns errCorruptFrame.
+// On a mapped store the returned bytes alias the mapping and are only valid
+// until the store is truncated or closed.
 func (s *store) Read(pos uint64) ([]byte, error) {
+	return s.read(pos, false)
+}
+
+// readCopy is Read for callers that hold no lock keeping the store open: the
+// frame is copied out of the mapping before mapMu is released, so unmapping the
+// store afterwards cannot invalidate it. It returns io.EOF at the end of the
+// store.
+func (s *store) readCopy(pos uint64) ([]byte, error) {
+	return s.read(pos, true)
+}
+
+func (s *store) read(pos uint64, clone bool) ([]byte, error) {
+	s.mapMu.RLock()
+
+	if s.mapped != nil {
+		defer s.mapMu.RUnlock()
+
+		if clone && pos >= uint64(len(s.mapped)) {
+			return nil, io.EOF
+		}
+
+		data, err := s.readMapped(pos)
+
+		if err != nil || !clone {
+			return data, err
+		}
+
+		return bytes.Clone(data), nil
+	}
+
+	s.mapMu.RUnlock()
+
+	if data, ok, err := s.readFlushed(pos); ok || err != nil {
+		return data, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.buf.Flush(); err != nil {
+	if clone && pos >= s.size {
+		return nil, io.EOF
+	}
+
+	if err := s.flush(); err != nil {
 		return nil, err
 	}
 
-	size := make([]byte, lenWidth)
+	data, ok, err := s.readFrame(pos, s.size)
 
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	if !ok && err == nil {
+		return nil, errCorruptFrame
 	}
 
-	data := make([]byte, enc.Uint64(size))
+	return data, err
+}
+
+// readFlushed reads the frame at pos without taking the lock. It reports false
+// when the frame is not entirely below the flushed size.
+func (s *store) readFlushed(pos uint64) ([]byte, bool, error) {
+	return s.readFrame(pos, s.flushed.Load())
+}
+
+// readFrame reads the frame at pos from the file, treating limit as the end of
+// the store. It reports false when the frame does not end before limit.
+func (s *store) readFrame(pos uint64, limit uint64) ([]byte, bool, error) {
+	width := s.frameHeaderWidth()
 
-	if _, err := s.File.ReadAt(data, int64(pos+lenWidth)); err != nil {
-		return nil, err
+	if pos+width > limit {
+		return nil, false, nil
+	}
+
+	header := make([]byte, width)
+
+	if _, err := s.File.ReadAt(header, int64(pos)); err != nil {
+		return nil, false, err
+	}
+
+	size := enc.Uint64(header[:lenWidth])
+
+	if size > limit-pos-width {
+		return nil, false, nil
+	}
+
+	data := make([]byte, size)
+
+	if _, err := s.File.ReadAt(data, int64(pos+width)); err != nil {
+		return nil, false, err
+	}
+
+	if !s.validFrame(header, data) {
+		return nil, false, errCorruptFrame
+	}
+
+	return data, true, nil
+}
+
+// isTorn reports whether the frame at pos runs past the end of the store.
+func (s *store) isTorn(pos uint64) (bool, error) {
+	width := s.frameHeaderWidth()
+
+	if pos+width > s.size {
+		return true, nil
+	}
+
+	header := make([]byte, lenWidth)
+
+	if _, err := s.ReadAt(header, int64(pos)); err != nil {
+		return false, err
+	}
+
+	return enc.Uint64(header) > s.size-pos-width, nil
+}
+
+// readMapped slices the frame at pos out of the mapping. Callers must hold
+// s.mapMu.
+func (s *store) readMapped(pos uint64) ([]byte, error) {
+	limit := uint64(len(s.mapped))
+	width := s.frameHeaderWidth()
+
+	if pos+width > limit {
+		return nil, errCorruptFrame
+	}
+
+	header := s.mapped[pos : pos+width]
+	size := enc.Uint64(header[:lenWidth])
+
+	if size > limit-pos-width {
+		return nil, errCorruptFrame
+	}
+
+	data := s.mapped[pos+width : pos+width+size]
+
+	if !s.validFrame(header, data) {
+		return nil, errCorruptFrame
 	}
 
 	return data, nil
 }
 
 func (s *store) ReadAt(data []byte, offset int64) (int, error) {
+	s.mapMu.RLock()
+
+	if s.mapped != nil {
+		defer s.mapMu.RUnlock()
+
+		if offset >= int64(len(s.mapped)) {
+			return 0, io.EOF
+		}
+
+		n := copy(data, s.mapped[offset:])
+
+		if n < len(data) {
+			return n, io.EOF
+		}
+
+		return n, nil
+	}
+
+	s.mapMu.RUnlock()
+
+	if uint64(offset)+uint64(len(data)) <= s.flushed.Load() {
+		return s.File.ReadAt(data, offset)
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if err := s.buf.Flush(); err != nil {
+	if err := s.flush(); err != nil {
 		return 0, err
 	}
 
 	return s.File.ReadAt(data, offset)
 }
 
+// flush writes the buffered tail to the file. Callers must hold s.mu.
+func (s *store) flush() error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	s.flushed.Store(s.size)
+
+	return nil
+}
+
+// Sync flushes the buffered tail under the lock and fsyncs outside it, so
+// appends to the store are not held up by the disk. The log runs it without
+// holding its own lock either, see Log.startSync.
+func (s *store) Sync() error {
+	s.mu.Lock()
+	err := s.flush()
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.File.Sync()
+}
+
+// Map flushes the store and maps it read-only. It must only be called once the
+// store no longer receives appends, like when its segment is rolled.
+func (s *store) Map() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+
+	// An empty file cannot be mapped, reads of it fail either way.
+	if s.mapped != nil || s.size == 0 {
+		return nil
+	}
+
+	mapped, err := mmap.Map(s.File, mmap.RDONLY, 0)
+
+	if err != nil {
+		return err
+	}
+
+	s.mapped = mapped
+
+	return nil
+}
+
+// unmap releases the mapping, if any, so later reads go to the file.
+func (s *store) unmap() error {
+	s.mapMu.Lock()
+	defer s.mapMu.Unlock()
+
+	if s.mapped == nil {
+		return nil
+	}
+
+	err := s.mapped.Unmap()
+	s.mapped = nil
+
+	return err
+}
+
+// Truncate cuts the store to size. Lock-free readers are not excluded, so the
+// caller must make sure nothing reads the bytes being dropped.
+func (s *store) Truncate(size uint64) error {
+	if err := s.unmap(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	s.size = size
+	s.flushed.Store(size)
+	return nil
+}
+
+// limit hides the bytes past size without changing the file. Read-only logs
+// use it in place of Truncate.
+func (s *store) limit(size uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.size = size
+	s.flushed.Store(size)
+}
+
 func (s *store) Close() error {
+	if err := s.unmap(); err != nil {
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
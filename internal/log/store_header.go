@@ -0,0 +1,196 @@
+package log
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// Stores of version 0 and 1 have no header, their first frame starts at 0.
+// Frames of version 0 are only prefixed by their length, since version 1 they
+// carry a checksum as well. Since version 2 a store starts with its magic, its
+// version and the features its frames may use; frames follow the header.
+const (
+	storeMagic = "LSTR"
+
+	baselineStoreVersion uint32 = 0
+	legacyStoreVersion   uint32 = 1
+	currentStoreVersion  uint32 = 2
+
+	storeVersionWidth = 4
+	storeFlagsWidth   = 8
+	storeHeaderWidth  = uint64(len(storeMagic) + storeVersionWidth + storeFlagsWidth)
+)
+
+// Store feature flags. A store carrying a flag this package does not know
+// cannot be read safely and is refused.
+const (
+	storeCompressed uint64 = 1 << iota
+	storeEncrypted
+
+	knownStoreFlags = storeCompressed | storeEncrypted
+)
+
+// storeFlags returns the features frames written under c may use.
+func storeFlags(c Config) uint64 {
+	var flags uint64
+
+	if c.Compression.Codec != nil {
+		flags |= storeCompressed
+	}
+
+	if c.Encryption.Keys != nil {
+		flags |= storeEncrypted
+	}
+
+	return flags
+}
+
+// readStoreHeader sets the version, flags and start of s from its header. A
+// store without one is of one of the headerless versions.
+func (s *store) readStoreHeader() error {
+	if s.size < storeHeaderWidth {
+		return s.detectHeaderless()
+	}
+
+	header := make([]byte, storeHeaderWidth)
+
+	if _, err := s.File.ReadAt(header, 0); err != nil && err != io.EOF {
+		return err
+	}
+
+	if string(header[:len(storeMagic)]) != storeMagic {
+		return s.detectHeaderless()
+	}
+
+	s.version = enc.Uint32(header[len(storeMagic):])
+	s.flags = enc.Uint64(header[len(storeMagic)+storeVersionWidth:])
+	s.start = storeHeaderWidth
+
+	if s.version > currentStoreVersion {
+		return unsupportedVersion(s.File, s.version)
+	}
+
+	if unknown := s.flags &^ knownStoreFlags; unknown != 0 {
+		return fmt.Errorf("%s: unsupported store features %#x", s.Name(), unknown)
+	}
+
+	return nil
+}
+
+// detectHeaderless tells the headerless versions apart by the first frame: it
+// is of version 1 when its checksum matches, a baseline store otherwise. An
+// empty store holds no frames and is taken to be of version 1, one too short
+// to hold a checksummed frame is read as a baseline store.
+func (s *store) detectHeaderless() error {
+	s.version = legacyStoreVersion
+
+	if s.size == 0 {
+		return nil
+	}
+
+	s.version = baselineStoreVersion
+
+	if s.size < headerWidth {
+		return nil
+	}
+
+	header := make([]byte, headerWidth)
+
+	if _, err := s.File.ReadAt(header, 0); err != nil {
+		return err
+	}
+
+	size := enc.Uint64(header[:lenWidth])
+
+	if size > s.size-headerWidth {
+		return nil
+	}
+
+	data := make([]byte, size)
+
+	if _, err := s.File.ReadAt(data, headerWidth); err != nil {
+		return err
+	}
+
+	if crc32.Checksum(data, crcTable) == enc.Uint32(header[lenWidth:]) {
+		s.version = legacyStoreVersion
+	}
+
+	return nil
+}
+
+// frameHeaderWidth returns the width of the header in front of every frame of
+// s. Baseline frames have no checksum.
+func (s *store) frameHeaderWidth() uint64 {
+	if s.version == baselineStoreVersion {
+		return lenWidth
+	}
+
+	return headerWidth
+}
+
+// validFrame reports whether data matches the checksum in its frame header.
+// Baseline frames carry none to check.
+func (s *store) validFrame(header, data []byte) bool {
+	if s.version == baselineStoreVersion {
+		return true
+	}
+
+	return crc32.Checksum(data, crcTable) == enc.Uint32(header[lenWidth:])
+}
+
+// writeStoreHeader starts the empty store s with a header of the current
+// version.
+func (s *store) writeStoreHeader(flags uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	header := make([]byte, storeHeaderWidth)
+
+	copy(header, storeMagic)
+	enc.PutUint32(header[len(storeMagic):], currentStoreVersion)
+	enc.PutUint64(header[len(storeMagic)+storeVersionWidth:], flags)
+
+	if _, err := s.File.Write(header); err != nil {
+		return err
+	}
+
+	s.version, s.flags, s.start = currentStoreVersion, flags, storeHeaderWidth
+	s.size = storeHeaderWidth
+	s.flushed.Store(s.size)
+
+	return nil
+}
+
+// addStoreFlags records flags in the header of s. The store is opened for
+// appending, so the header is rewritten through a second handle.
+func (s *store) addStoreFlags(flags uint64) error {
+	if s.flags|flags == s.flags {
+		return nil
+	}
+
+	file, err := os.OpenFile(s.Name(), os.O_WRONLY, 0)
+
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	value := make([]byte, storeFlagsWidth)
+	enc.PutUint64(value, s.flags|flags)
+
+	if _, err := file.WriteAt(value, int64(len(storeMagic)+storeVersionWidth)); err != nil {
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+
+	s.flags |= flags
+
+	return nil
+}
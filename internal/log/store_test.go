@@ -1,6 +1,7 @@
 package log
 
 import (
+	"io"
 	"os"
 	"testing"
 
@@ -9,7 +10,7 @@ import (
 
 var (
 	write = []byte("Hello world")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + headerWidth
 )
 
 func TestStoreAppendRead(t *testing.T) {
@@ -24,6 +25,8 @@ func TestStoreAppendRead(t *testing.T) {
 	require.NoError(t, err)
 
 	testAppend(t, s)
+	testRead(t, s)
+	testReadAt(t, s)
 }
 
 func testAppend(t *testing.T, s *store) {
@@ -53,12 +56,12 @@ func testRead(t *testing.T, s *store) {
 func testReadAt(t *testing.T, s *store) {
 	t.Helper()
 	for i, off := uint64(1), int64(0); i < 4; i++ {
-		b := make([]byte, lenWidth)
+		b := make([]byte, headerWidth)
 		n, err := s.ReadAt(b, off)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, n)
+		require.Equal(t, headerWidth, n)
 		off += int64(n)
-		size := enc.Uint64(b)
+		size := enc.Uint64(b[:lenWidth])
 		b = make([]byte, size)
 		n, err = s.ReadAt(b, off)
 		require.NoError(t, err)
@@ -68,6 +71,125 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreCorruption(t *testing.T) {
+	f, err := os.CreateTemp("", "store_corruption_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.NoError(t, err)
+
+	// Flip a bit inside the record bytes
+	_, err = f.WriteAt([]byte{write[0] ^ 0x01}, int64(pos+headerWidth))
+	require.NoError(t, err)
+
+	_, err = s.Read(pos)
+	require.Equal(t, errCorruptFrame, err)
+
+	// A frame running past the end of the store is corrupt too
+	_, err = s.Read(pos + 1)
+	require.Equal(t, errCorruptFrame, err)
+}
+
+func TestStoreConcurrentReads(t *testing.T) {
+	f, err := os.CreateTemp("", "store_concurrent_reads_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	const frames = 200
+	positions := make(chan uint64, frames)
+
+	// The appender reports its error over errs, FailNow only works on the
+	// test goroutine.
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(positions)
+		defer close(errs)
+
+		for i := 0; i < frames; i++ {
+			_, pos, err := s.Append(write)
+
+			if err == nil && i%10 == 0 {
+				err = s.Sync()
+			}
+
+			if err != nil {
+				errs <- err
+				return
+			}
+
+			positions <- pos
+		}
+	}()
+
+	for pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+
+	require.NoError(t, <-errs)
+
+	require.Equal(t, s.size, s.flushed.Load())
+	require.Equal(t, width*frames, s.size)
+}
+
+func TestStoreMap(t *testing.T) {
+	f, err := os.CreateTemp("", "store_map_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+
+	testAppend(t, s)
+	require.NoError(t, s.Map())
+	require.NotNil(t, s.mapped)
+
+	testRead(t, s)
+	testReadAt(t, s)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := s.Read(width)
+		require.NoError(t, err)
+	})
+	require.Zero(t, allocs)
+
+	copied, err := s.readCopy(width)
+	require.NoError(t, err)
+
+	_, err = s.readCopy(s.size)
+	require.Equal(t, io.EOF, err)
+
+	require.NoError(t, s.Truncate(width*2))
+	require.Nil(t, s.mapped)
+	require.Equal(t, write, copied)
+
+	_, err = s.readCopy(width * 2)
+	require.Equal(t, io.EOF, err)
+
+	_, err = s.Read(width * 2)
+	require.Equal(t, errCorruptFrame, err)
+
+	read, err := s.Read(width)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	require.NoError(t, s.Map())
+	require.NoError(t, s.Close())
+	require.Nil(t, s.mapped)
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
@@ -0,0 +1,93 @@
+package log
+
+import (
+	"log"
+	"time"
+)
+
+const defaultSyncInterval = 100 * time.Millisecond
+
+// syncBatch is shared by the Appends waiting for the next sync under
+// SyncInterval. done is closed once the sync has finished.
+type syncBatch struct {
+	done chan struct{}
+	err  error
+}
+
+// sync fsyncs the active segment and releases the Appends waiting on it.
+// Callers must hold l.mu.
+func (l *Log) sync() error {
+	return l.startSync()()
+}
+
+// startSync takes the records waiting for a sync off the log and returns the
+// fsync that covers them, which releases their Appends once done. Callers must
+// hold l.mu but can let go of it before the fsync, so reads and appends are not
+// held up by the disk.
+func (l *Log) startSync() func() error {
+	s, batch := l.activeSegment, l.pending
+
+	l.unsynced = 0
+	l.pending = nil
+
+	return func() error {
+		err := s.Sync()
+
+		if batch != nil {
+			batch.err = err
+			close(batch.done)
+		}
+
+		return err
+	}
+}
+
+// awaitSync counts appended records against the sync policy. It returns the
+// batch their callers have to wait on, or the fsync they have to run
+// themselves once l.mu is released; both are nil when the records are already
+// durable as far as the policy is concerned. Callers must hold l.mu.
+func (l *Log) awaitSync(appended uint64) (*syncBatch, func() error) {
+	if appended == 0 {
+		return nil, nil
+	}
+
+	switch l.Config.Sync.Policy {
+	case SyncEveryAppend:
+		return nil, l.startSync()
+
+	case SyncInterval:
+		l.unsynced += appended
+
+		if l.Config.Sync.Records > 0 && l.unsynced >= l.Config.Sync.Records {
+			return nil, l.startSync()
+		}
+
+		if l.pending == nil {
+			l.pending = &syncBatch{done: make(chan struct{})}
+		}
+
+		return l.pending, nil
+	}
+
+	return nil, nil
+}
+
+// syncPending fsyncs the active segment when appended records are still
+// waiting for a sync.
+func (l *Log) syncPending() {
+	l.mu.Lock()
+
+	if l.unsynced == 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	baseOffset := l.activeSegment.baseOffset
+	sync := l.startSync()
+
+	l.mu.Unlock()
+
+	if err := sync(); err != nil {
+		log.Printf("sync segment %d: %v", baseOffset, err)
+	}
+}
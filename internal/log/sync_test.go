@@ -0,0 +1,95 @@
+package log
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSync(t *testing.T) {
+	scenarios := map[string]func(t *testing.T, c Config){
+		"sync every append":                 testSyncEveryAppend,
+		"sync interval waits for records":   testSyncIntervalRecords,
+		"sync interval waits for the timer": testSyncIntervalTimer,
+		"sync on roll":                      testSyncOnRoll,
+	}
+	for scenario, fn := range scenarios {
+		t.Run(scenario, func(t *testing.T) {
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+
+			fn(t, c)
+		})
+	}
+}
+
+func requireOnDisk(t *testing.T, s *segment) {
+	t.Helper()
+
+	fi, err := os.Stat(s.store.Name())
+	require.NoError(t, err)
+	require.Equal(t, s.store.size, uint64(fi.Size()))
+}
+
+func testSyncEveryAppend(t *testing.T, c Config) {
+	c.Sync.Policy = SyncEveryAppend
+	log := newTestLog(t, c)
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	requireOnDisk(t, log.activeSegment)
+}
+
+func testSyncIntervalRecords(t *testing.T, c Config) {
+	c.Sync.Policy = SyncInterval
+	c.Sync.Records = 2
+	c.Sync.Interval = time.Hour
+	log := newTestLog(t, c)
+
+	appended := make(chan uint64)
+	go func() {
+		off, err := log.Append(&api.Record{Value: []byte("first")})
+		require.NoError(t, err)
+		appended <- off
+	}()
+
+	select {
+	case <-appended:
+		t.Fatal("append returned before its record was synced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	off, err := log.Append(&api.Record{Value: []byte("second")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, uint64(0), <-appended)
+	requireOnDisk(t, log.activeSegment)
+}
+
+func testSyncIntervalTimer(t *testing.T, c Config) {
+	c.Sync.Policy = SyncInterval
+	c.Sync.Interval = 10 * time.Millisecond
+	log := newTestLog(t, c)
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	requireOnDisk(t, log.activeSegment)
+}
+
+func testSyncOnRoll(t *testing.T, c Config) {
+	c.Sync.Policy = SyncOnRoll
+	c.Segment.MaxStoreBytes = 32
+	log := newTestLog(t, c)
+
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.GreaterOrEqual(t, len(log.segments), 2)
+	requireOnDisk(t, log.segments[0])
+}
@@ -0,0 +1,118 @@
+package log
+
+import (
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+// timeIndex maps append timestamps to relative offsets. An entry is written for
+// the first record carrying a timestamp greater than every timestamp before it,
+// so the entries are sorted by both timestamp and offset.
+type timeIndex struct {
+	entryFile
+}
+
+var (
+	timestampWidth  uint64 = 8
+	timeOffsetWidth uint64 = 8
+	timeEntryWidth         = timestampWidth + timeOffsetWidth
+)
+
+// newTimeIndex opens the time index stored in file. A time index written in
+// the legacy layout is emptied, recovery then rebuilds it from the store. A
+// read-only time index whose file is missing is passed as a nil file and
+// starts out empty.
+func newTimeIndex(file *os.File, config Config) (*timeIndex, error) {
+	var size uint64
+
+	if file != nil {
+		version, err := readHeader(file, timeIndexMagic)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if version == 0 && !config.ReadOnly {
+			if err := writeHeader(file, timeIndexMagic, timeIndexVersion, nil); err != nil {
+				return nil, err
+			}
+		}
+
+		if size, err = entriesSize(file, timeIndexMagic, timeIndexVersion); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := openEntryFile(file, size, timeEntryWidth, config)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &timeIndex{f}, nil
+}
+
+func (t *timeIndex) Read(entry uint64) (int64, uint64, error) {
+	b := t.entry(entry)
+
+	if b == nil {
+		return 0, 0, io.EOF
+	}
+
+	return int64(enc.Uint64(b[:timestampWidth])), enc.Uint64(b[timestampWidth:]), nil
+}
+
+func (t *timeIndex) Write(timestamp int64, offset uint64) error {
+	return t.write(timestamp, offset, t.limit)
+}
+
+// writeRecovered writes an entry even past the limit of the time index, see
+// index.writeRecovered.
+func (t *timeIndex) writeRecovered(timestamp int64, offset uint64) error {
+	return t.write(timestamp, offset, math.MaxUint64)
+}
+
+func (t *timeIndex) write(timestamp int64, offset uint64, limit uint64) error {
+	entry, err := t.append(limit)
+
+	if err != nil {
+		return err
+	}
+
+	enc.PutUint64(entry[:timestampWidth], uint64(timestamp))
+	enc.PutUint64(entry[timestampWidth:], offset)
+
+	return nil
+}
+
+// Lookup returns the relative offset of the first record appended at or after
+// timestamp.
+func (t *timeIndex) Lookup(timestamp int64) (uint64, error) {
+	entry := uint64(sort.Search(int(t.Entries()), func(i int) bool {
+		ts, _, _ := t.Read(uint64(i))
+		return ts >= timestamp
+	}))
+
+	_, offset, err := t.Read(entry)
+
+	return offset, err
+}
+
+// Before returns the relative offset of the last entry older than timestamp,
+// or io.EOF when there is none.
+func (t *timeIndex) Before(timestamp int64) (uint64, error) {
+	entry := sort.Search(int(t.Entries()), func(i int) bool {
+		ts, _, _ := t.Read(uint64(i))
+		return ts >= timestamp
+	})
+
+	if entry == 0 {
+		return 0, io.EOF
+	}
+
+	_, offset, err := t.Read(uint64(entry - 1))
+
+	return offset, err
+}
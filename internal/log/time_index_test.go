@@ -0,0 +1,99 @@
+package log
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeIndex(t *testing.T) {
+	f, err := os.CreateTemp("", "time_index_test")
+
+	require.NoError(t, err)
+
+	defer os.Remove(f.Name())
+
+	c := Config{}
+
+	c.Segment.MaxIndexBytes = 1024
+
+	index, err := newTimeIndex(f, c)
+
+	require.NoError(t, err)
+
+	_, err = index.Lookup(0)
+
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, f.Name(), index.Name())
+
+	entries := []struct {
+		Timestamp int64
+		Offset    uint64
+	}{
+		{Timestamp: 100, Offset: 0},
+		{Timestamp: 200, Offset: 3},
+		{Timestamp: 300, Offset: 7},
+	}
+
+	for i, want := range entries {
+		err := index.Write(want.Timestamp, want.Offset)
+
+		require.NoError(t, err)
+
+		timestamp, offset, err := index.Read(uint64(i))
+
+		require.NoError(t, err)
+		require.Equal(t, want.Timestamp, timestamp)
+		require.Equal(t, want.Offset, offset)
+	}
+
+	lookups := map[int64]uint64{50: 0, 100: 0, 101: 3, 200: 3, 250: 7, 300: 7}
+
+	for timestamp, want := range lookups {
+		offset, err := index.Lookup(timestamp)
+
+		require.NoError(t, err)
+		require.Equal(t, want, offset)
+	}
+
+	// Every record is older
+	_, err = index.Lookup(301)
+
+	require.Equal(t, io.EOF, err)
+
+	err = index.Close()
+	require.NoError(t, err)
+
+	// Index should build its state from the existing file
+	f, _ = os.OpenFile(f.Name(), os.O_RDWR, 0600)
+
+	index, err = newTimeIndex(f, c)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), index.Entries())
+}
+
+func TestTimeIndexDropsLegacy(t *testing.T) {
+	f, err := os.CreateTemp("", "time_index_legacy_test")
+
+	require.NoError(t, err)
+
+	defer os.Remove(f.Name())
+
+	// Version 1 entries have no header and are rebuilt from the store instead
+	_, err = f.Write(make([]byte, 24))
+
+	require.NoError(t, err)
+
+	c := Config{}
+
+	c.Segment.MaxIndexBytes = 1024
+
+	index, err := newTimeIndex(f, c)
+
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), index.Entries())
+	require.NoError(t, index.Close())
+}
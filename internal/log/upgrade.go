@@ -0,0 +1,109 @@
+package log
+
+import (
+	"log"
+	"slices"
+
+	api "distributed-services-in-go/api/v1"
+)
+
+// Upgraded describes a segment rewritten into the current store format.
+type Upgraded struct {
+	BaseOffset  uint64
+	FromVersion uint32
+	ToVersion   uint32
+}
+
+// Upgrade rewrites every segment whose store predates the current format.
+// Records keep their offsets and are rewritten under the current config. An
+// active segment in an old format is rolled first, so appends carry on in a
+// new segment while it is rewritten.
+func (l *Log) Upgrade() ([]Upgraded, error) {
+	return l.upgradeSegments(nil)
+}
+
+// upgradeSegments upgrades the segments of the log, stopping between segments
+// once stop is closed.
+func (l *Log) upgradeSegments(stop <-chan struct{}) ([]Upgraded, error) {
+	if l.Config.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	l.maintenanceMu.Lock()
+	defer l.maintenanceMu.Unlock()
+
+	l.mu.Lock()
+
+	isEmpty := l.activeSegment.nextOffset == l.activeSegment.baseOffset
+
+	if l.activeSegment.store.version < currentStoreVersion && !isEmpty {
+		if err := l.roll(); err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	segments := slices.Clone(l.segments[:len(l.segments)-1])
+
+	l.mu.Unlock()
+
+	upgraded := []Upgraded{}
+
+	for _, s := range segments {
+		select {
+		case <-stop:
+			return upgraded, nil
+		default:
+		}
+
+		if s.store.version == currentStoreVersion {
+			continue
+		}
+
+		u := Upgraded{BaseOffset: s.baseOffset, FromVersion: s.store.version, ToVersion: currentStoreVersion}
+
+		_, err := l.rewriteSegment(s, func(*api.Record) bool { return true })
+
+		if err != nil {
+			return upgraded, err
+		}
+
+		upgraded = append(upgraded, u)
+	}
+
+	return upgraded, nil
+}
+
+// needsUpgrade reports whether any segment of the log predates the current
+// store format.
+func (l *Log) needsUpgrade() bool {
+	for _, s := range l.segments {
+		if s.store.version < currentStoreVersion {
+			return true
+		}
+	}
+
+	return false
+}
+
+// upgrade runs Upgrade once in the background, giving up when the log is
+// closed.
+func (l *Log) upgrade() {
+	done := l.done
+
+	l.wg.Add(1)
+
+	go func() {
+		defer l.wg.Done()
+
+		upgraded, err := l.upgradeSegments(done)
+
+		for _, u := range upgraded {
+			log.Printf("upgraded segment %d from format version %d to %d", u.BaseOffset, u.FromVersion, u.ToVersion)
+		}
+
+		if err != nil {
+			log.Printf("upgrade: %v", err)
+		}
+	}()
+}
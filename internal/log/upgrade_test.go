@@ -0,0 +1,238 @@
+package log
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// writeHeaderlessSegment writes a segment at baseOffset byte for byte in the
+// layout of a headerless store version: frames prefixed by their length, and
+// since version 1 by a checksum as well, next to an index of 4-byte relative
+// offsets without a header.
+func writeHeaderlessSegment(t *testing.T, dir string, baseOffset uint64, records int, version uint32) {
+	t.Helper()
+
+	store, index := []byte{}, []byte{}
+
+	for i := 0; i < records; i++ {
+		b, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: baseOffset + uint64(i)})
+		require.NoError(t, err)
+
+		entry := make([]byte, legacyEntryWidth)
+		enc.PutUint32(entry[:legacyOffsetWidth], uint32(i))
+		enc.PutUint64(entry[legacyOffsetWidth:], uint64(len(store)))
+		index = append(index, entry...)
+
+		store = enc.AppendUint64(store, uint64(len(b)))
+
+		if version == legacyStoreVersion {
+			store = enc.AppendUint32(store, crc32.Checksum(b, crcTable))
+		}
+
+		store = append(store, b...)
+	}
+
+	name := path.Join(dir, fmt.Sprint(baseOffset))
+	require.NoError(t, os.WriteFile(name+".store", store, 0644))
+	require.NoError(t, os.WriteFile(name+".index", index, 0644))
+}
+
+// writeHeaderlessSegments writes records with the offsets 0 to 4 split over
+// two segments of the given headerless version.
+func writeHeaderlessSegments(t *testing.T, dir string, version uint32) {
+	t.Helper()
+
+	writeHeaderlessSegment(t, dir, 0, 3, version)
+	writeHeaderlessSegment(t, dir, 3, 2, version)
+}
+
+func requireRecords(t *testing.T, log *Log, records uint64) {
+	t.Helper()
+
+	for off := uint64(0); off < records; off++ {
+		got, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, []byte("hello world"), got.Value)
+	}
+}
+
+func TestBaselineStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "baseline-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeHeaderlessSegment(t, dir, 0, 3, baselineStoreVersion)
+
+	fi, err := os.Stat(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.Empty(t, log.Repairs)
+	require.Equal(t, baselineStoreVersion, log.activeSegment.store.version)
+	require.Equal(t, uint64(fi.Size()), log.activeSegment.store.size)
+	requireRecords(t, log, 3)
+
+	// Appends keep to the layout of the store.
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Empty(t, log.Repairs)
+	require.Equal(t, baselineStoreVersion, log.activeSegment.store.version)
+	requireRecords(t, log, 4)
+
+	// Reader gives baseline frames the checksum they lack.
+	b, err := io.ReadAll(log.Reader())
+	require.NoError(t, err)
+
+	for off := 0; off < 4; off++ {
+		size := enc.Uint64(b[:lenWidth])
+		require.Equal(t, crc32.Checksum(b[headerWidth:headerWidth+size], crcTable), enc.Uint32(b[lenWidth:headerWidth]))
+		b = b[headerWidth+size:]
+	}
+
+	require.Empty(t, b)
+}
+
+func TestBaselineStoreFullIndex(t *testing.T) {
+	dir, err := os.MkdirTemp("", "baseline-full-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 85 entries filled a baseline index, they take more room since.
+	writeHeaderlessSegment(t, dir, 0, 85, baselineStoreVersion)
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Equal(t, []Repair{{RecoveredRecords: 85}}, log.Repairs)
+	requireRecords(t, log, 85)
+
+	// The segment is full, appends go to the next one.
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(85), off)
+	require.Len(t, log.segments, 2)
+}
+
+func TestUpgrade(t *testing.T) {
+	for _, version := range []uint32{baselineStoreVersion, legacyStoreVersion} {
+		t.Run(fmt.Sprintf("version %d", version), func(t *testing.T) {
+			testUpgrade(t, version)
+		})
+	}
+}
+
+func testUpgrade(t *testing.T, version uint32) {
+	dir, err := os.MkdirTemp("", "upgrade-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeHeaderlessSegments(t, dir, version)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.Empty(t, log.Repairs)
+	requireRecords(t, log, 5)
+
+	for _, s := range log.segments {
+		require.Equal(t, version, s.store.version)
+		require.Zero(t, s.store.start)
+	}
+
+	// The active segment keeps its format until it is upgraded.
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, version, log.activeSegment.store.version)
+
+	upgraded, err := log.Upgrade()
+	require.NoError(t, err)
+	require.Equal(t, []Upgraded{
+		{BaseOffset: 0, FromVersion: version, ToVersion: currentStoreVersion},
+		{BaseOffset: 3, FromVersion: version, ToVersion: currentStoreVersion},
+	}, upgraded)
+
+	for _, s := range log.segments {
+		require.Equal(t, currentStoreVersion, s.store.version)
+	}
+
+	requireRecords(t, log, 6)
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Empty(t, log.Repairs)
+	requireRecords(t, log, 6)
+
+	upgraded, err = log.Upgrade()
+	require.NoError(t, err)
+	require.Empty(t, upgraded)
+}
+
+func TestUpgradeBackground(t *testing.T) {
+	dir, err := os.MkdirTemp("", "upgrade-background-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	writeHeaderlessSegments(t, dir, baselineStoreVersion)
+
+	c := Config{}
+	c.Upgrade.Background = true
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Eventually(t, func() bool {
+		log.mu.RLock()
+		defer log.mu.RUnlock()
+
+		return !log.needsUpgrade()
+	}, time.Second, 10*time.Millisecond)
+
+	requireRecords(t, log, 5)
+}
+
+func TestStoreHeaderFlags(t *testing.T) {
+	c := Config{}
+	log := newTestLog(t, c)
+	require.Equal(t, currentStoreVersion, log.activeSegment.store.version)
+	require.Zero(t, log.activeSegment.store.flags)
+	require.NoError(t, log.Close())
+
+	c.Compression.Codec = FlateCodec{}
+	log, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.Equal(t, storeCompressed, log.activeSegment.store.flags)
+	require.NoError(t, log.Close())
+
+	// Flags this version does not know make the store unreadable.
+	f, err := os.OpenFile(log.activeSegment.store.Name(), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0x80}, int64(len(storeMagic)+storeVersionWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = NewLog(log.Dir, c)
+	require.ErrorContains(t, err, "unsupported store features")
+}
@@ -0,0 +1,44 @@
+package log
+
+import (
+	"context"
+	"os"
+)
+
+// Wait blocks until the record at off has been appended, or ctx is done. It
+// returns right away when off was already appended, even if retention or
+// compaction removed it since. A read-only log wakes up when Refresh picks up
+// new records. Closing the log wakes every waiter with os.ErrClosed.
+func (l *Log) Wait(ctx context.Context, off uint64) error {
+	for {
+		l.mu.RLock()
+		closed := l.activeSegment.closed
+		appended := off < l.activeSegment.nextOffset
+		notify := l.appended
+		l.mu.RUnlock()
+
+		if closed {
+			return os.ErrClosed
+		}
+
+		if appended {
+			return nil
+		}
+
+		select {
+		case <-notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyAppended wakes every Wait call to check the log again. It must be
+// called with mu held.
+func (l *Log) notifyAppended() {
+	if l.appended != nil {
+		close(l.appended)
+	}
+
+	l.appended = make(chan struct{})
+}
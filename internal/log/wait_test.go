@@ -0,0 +1,88 @@
+package log
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	api "distributed-services-in-go/api/v1"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWait(t *testing.T) {
+	log := newTestLog(t, Config{})
+
+	_, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	// Appended records do not block.
+	require.NoError(t, log.Wait(context.Background(), 0))
+
+	// A waiter wakes up once its offset is appended.
+	woken := make(chan error)
+
+	go func() {
+		woken <- log.Wait(context.Background(), 1)
+	}()
+
+	select {
+	case err := <-woken:
+		t.Fatalf("woke up before the record was appended: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, <-woken)
+
+	// A cancelled context stops waiting.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	require.ErrorIs(t, log.Wait(ctx, 2), context.DeadlineExceeded)
+
+	// Closing the log wakes every waiter.
+	go func() {
+		woken <- log.Wait(context.Background(), 2)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, log.Close())
+	require.ErrorIs(t, <-woken, os.ErrClosed)
+}
+
+func TestWaitFollow(t *testing.T) {
+	c := Config{}
+	c.Sync.Policy = SyncEveryAppend
+	writer := newTestLog(t, c)
+
+	_, err := writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	c.ReadOnly = true
+	c.Follow.Interval = 10 * time.Millisecond
+	reader, err := NewLog(writer.Dir, c)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	woken := make(chan error)
+
+	go func() {
+		woken <- reader.Wait(context.Background(), 1)
+	}()
+
+	_, err = writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+
+	select {
+	case err := <-woken:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("follower did not wake up")
+	}
+
+	_, err = reader.Read(1)
+	require.NoError(t, err)
+}